@@ -0,0 +1,69 @@
+// loc - cache maintenance command
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"loc/counter"
+)
+
+// runCache runs the cache command, currently only "cache prune"
+func runCache(args []string) error {
+	if len(args) == 0 || args[0] != "prune" {
+		return fmt.Errorf("expected a subcommand: prune")
+	}
+
+	flags := flag.NewFlagSet("cache prune", flag.ExitOnError)
+	cacheDir := flags.String("cache-dir", "", "cache directory to prune, as given to -cache-dir when counting")
+	maxAge := flags.Duration("max-age", 30*24*time.Hour, "remove caches of directories not counted for this long, 0 to keep them")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 { // the cache directory may also be given as an argument
+		*cacheDir = flags.Arg(0)
+	}
+	if *cacheDir == "" {
+		return fmt.Errorf("no cache directory given, use -cache-dir")
+	}
+
+	removed, err := counter.PruneCache(*cacheDir, *maxAge)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %d cache files\n", removed)
+	return nil
+}
@@ -0,0 +1,171 @@
+// loc - count lines of code inside archives
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archiveFormats maps the archive file extensions loc reads to the format of the archive
+var archiveFormats = map[string]string{
+	".tar":    "tar",
+	".tar.gz": "tar.gz",
+	".tgz":    "tar.gz",
+	".zip":    "zip",
+	".jar":    "zip",
+	".war":    "zip",
+}
+
+// archiveFormat returns the format of the archive a path names by its extension, or an empty string if it is not an archive
+func archiveFormat(path string) string {
+	for ext, format := range archiveFormats {
+		if strings.HasSuffix(strings.ToLower(path), ext) {
+			return format
+		}
+	}
+	return ""
+}
+
+// IsArchive checks if path is an archive file whose members can be counted
+func IsArchive(path string) bool {
+	if archiveFormat(path) == "" {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// scanArchive counts the lines of code in the members of the archive at Directory without extracting it
+func (s *scanner) scanArchive(ctx context.Context) error {
+	format := archiveFormat(s.Directory)
+	if format == "zip" {
+		return s.scanZip(ctx)
+	}
+
+	file, err := os.Open(s.Directory)
+	if err != nil {
+		return err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file) // defer the closure of the file
+
+	var r io.Reader = file
+	if format == "tar.gz" { // decompress while reading
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer func(gzipReader *gzip.Reader) {
+			_ = gzipReader.Close()
+		}(gzipReader)
+		r = gzipReader
+	}
+
+	return s.scanTar(ctx, r)
+}
+
+// scanTar counts the lines of code in the regular files of a tar stream
+func (s *scanner) scanTar(ctx context.Context, r io.Reader) error {
+	tarReader := tar.NewReader(r)
+	for {
+		// Stop when the caller gives up
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		header, err := tarReader.Next()
+		if err == io.EOF { // end of the archive
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg { // directories, links and devices hold no code
+			continue
+		}
+
+		if err := s.countMember(header.Name, header.Size, tarReader); err != nil {
+			return err
+		}
+	}
+}
+
+// scanZip counts the lines of code in the files of a zip archive such as a jar, walking it as a filesystem
+func (s *scanner) scanZip(ctx context.Context) error {
+	zipReader, err := zip.OpenReader(s.Directory)
+	if err != nil {
+		return err
+	}
+	defer func(zipReader *zip.ReadCloser) {
+		_ = zipReader.Close()
+	}(zipReader)
+
+	for _, file := range zipReader.File {
+		if !file.FileInfo().IsDir() && s.listed(strings.TrimPrefix(path.Clean("/"+file.Name), "/")) {
+			s.progress.FilesTotal++ // the central directory lists every member up front
+		}
+	}
+
+	s.FS = zipReader
+	return s.scan(ctx)
+}
+
+// countMember counts the lines of code of an archive member of size bytes, applying the same rules as the
+// directory walk to its path inside the archive
+func (s *scanner) countMember(name string, size int64, r io.Reader) error {
+	// members are addressed as if the archive were a directory
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	memberPath := filepath.Join(s.Directory, filepath.FromSlash(name))
+
+	if s.shouldExcludeTreePath(memberPath) || s.outOfBoundsFile(name) || s.skipVendoredFile(name) {
+		return nil
+	}
+	s.visit(name)
+	defer s.emit()
+
+	language := s.Config.DetectLanguage(memberPath)
+	if language == "" || s.overSizeLimit(name, size) { // not a file we count, the member is skipped unread
+		return nil
+	}
+
+	_, _, err := s.count(name, language, r)
+	return err
+}
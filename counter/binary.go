@@ -0,0 +1,74 @@
+// loc - detection of binary files
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// maxInvalidUTF8 is the share of invalid UTF-8 in the first block above which a file is binary.
+// It leaves room for the odd Latin-1 accent in a text file.
+const maxInvalidUTF8 = 0.3
+
+// isBinary sniffs the first block of a file, as peeked for the generated markers, and reports whether it
+// holds binary data rather than text: a NUL byte, or too much that is not valid UTF-8
+func isBinary(block []byte) bool {
+	if len(block) == 0 {
+		return false // an empty file is an empty text file
+	}
+	if bytes.IndexByte(block, 0) >= 0 {
+		return true
+	}
+
+	return float64(invalidUTF8(block))/float64(len(block)) > maxInvalidUTF8
+}
+
+// invalidUTF8 returns the number of bytes in block that are not valid UTF-8
+func invalidUTF8(block []byte) int {
+	invalid := 0
+	for i := 0; i < len(block); {
+		if !utf8.FullRune(block[i:]) { // cut off at the end of the block
+			break
+		}
+		r, size := utf8.DecodeRune(block[i:])
+		if r == utf8.RuneError && size == 1 {
+			invalid++
+		}
+		i += size
+	}
+	return invalid
+}
+
+// skipBinary records the file name as binary, it is not counted
+func (s *scanner) skipBinary(name string) {
+	s.Binary = append(s.Binary, name)
+}
@@ -0,0 +1,315 @@
+// loc - persistent cache of per-file counts
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cacheVersion is part of every fingerprint, bump it when the way lines are classified changes
+const cacheVersion = "5"
+
+// cacheEntry holds the counts of a file as they were when the file had the recorded size and mtime
+type cacheEntry struct {
+	Size     int64  `json:"size"`           // Size of the file in bytes
+	ModTime  int64  `json:"mtime"`          // Modification time in Unix nanoseconds
+	Hash     string `json:"hash,omitempty"` // SHA-256 of the contents, when hashing is enabled
+	Language string `json:"language"`       // The language the file was counted as
+	Counts   Counts `json:"counts"`         // The lines of the file
+
+	LineEndings string `json:"line_endings,omitempty"` // The line ending style of the file
+	CountedAs   string `json:"counted_as,omitempty"`   // The language the lines were counted as, when it is not Language
+
+	Embedded map[string]Counts `json:"embedded,omitempty"` // The lines of embedded languages
+}
+
+// cacheFile is the cache of one scanned directory as it is stored on disk
+type cacheFile struct {
+	Root        string                `json:"root"`        // Absolute path of the scanned directory
+	Fingerprint string                `json:"fingerprint"` // Fingerprint of the config the files were counted with
+	Files       map[string]cacheEntry `json:"files"`       // Entries by slash separated name below Root
+}
+
+// fileCache looks up and records the counts of files during a scan
+type fileCache struct {
+	path  string                // The cache file
+	hash  bool                  // Match files on their content hash instead of their mtime
+	old   cacheFile             // The entries of the previous scan
+	fresh map[string]cacheEntry // The entries of this scan, files that are gone are dropped on save
+}
+
+// configFingerprint identifies the language configuration and the options changing how files are counted,
+// counts made with another configuration are not reused
+func configFingerprint(config *Config, countGenerated bool) (string, error) {
+	data, err := json.Marshal(config) // map keys are sorted, so equal configs marshal equally
+	if err != nil {
+		return "", err
+	}
+	options := fmt.Sprintf("%s %t\n", cacheVersion, countGenerated)
+	sum := sha256.Sum256(append([]byte(options), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// contentHash returns the hex SHA-256 of data
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// openFileCache opens the cache of root in dir for counts with the given config fingerprint. A missing,
+// unreadable or outdated cache starts out empty.
+func openFileCache(dir, root, fingerprint string, hash bool) (*fileCache, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256([]byte(absRoot))
+	c := &fileCache{
+		path:  filepath.Join(dir, hex.EncodeToString(sum[:8])+".json"),
+		hash:  hash,
+		fresh: make(map[string]cacheEntry),
+	}
+
+	data, err := os.ReadFile(c.path)
+	if err == nil {
+		_ = json.Unmarshal(data, &c.old) // a corrupt cache is as good as none
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	// start over when the config changed, e.g. a skip pattern was edited
+	if c.old.Root != absRoot || c.old.Fingerprint != fingerprint {
+		c.old = cacheFile{}
+	}
+	c.old.Root = absRoot
+	c.old.Fingerprint = fingerprint
+
+	return c, nil
+}
+
+// lookup returns the cached counts of a file, which match when the file has not changed since it was counted.
+// hash is the content hash of the file and is only compared when hashing is enabled.
+func (c *fileCache) lookup(name, language string, info fs.FileInfo, hash string) (FileCounts, bool) {
+	entry, ok := c.old.Files[name]
+	if !ok || entry.Language != language {
+		return FileCounts{}, false
+	}
+
+	if c.hash {
+		ok = entry.Hash == hash // touched or freshly checked out files keep their counts
+	} else {
+		ok = entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano()
+	}
+	if !ok {
+		return FileCounts{}, false
+	}
+
+	file := FileCounts{Path: name, Language: cmp.Or(entry.CountedAs, language), Counts: entry.Counts, LineEndings: entry.LineEndings, Embedded: entry.Embedded}
+	c.store(language, info, hash, file)
+	return file, true
+}
+
+// store records the counts of a file detected as language for the next scan
+func (c *fileCache) store(language string, info fs.FileInfo, hash string, file FileCounts) {
+	entry := cacheEntry{
+		Size:        info.Size(),
+		ModTime:     info.ModTime().UnixNano(),
+		Hash:        hash,
+		Language:    language,
+		Counts:      file.Counts,
+		LineEndings: file.LineEndings,
+		Embedded:    file.Embedded,
+	}
+	if file.Language != language { // a notebook, counted as the language of its kernel
+		entry.CountedAs = file.Language
+	}
+	c.fresh[file.Path] = entry
+}
+
+// save writes the entries of this scan to the cache file
+func (c *fileCache) save() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cacheFile{Root: c.old.Root, Fingerprint: c.old.Fingerprint, Files: c.fresh})
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so an interrupted save never leaves a truncated cache
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".loc-cache-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// scanWithCache scans FS like scan, reusing the counts in the cache of root kept in dir and updating it
+func (s *scanner) scanWithCache(ctx context.Context, dir, root string, hash bool) error {
+	fingerprint, err := configFingerprint(s.Config, s.countGenerated)
+	if err != nil {
+		return err
+	}
+	cache, err := openFileCache(dir, root, fingerprint, hash)
+	if err != nil {
+		return err
+	}
+
+	s.cache = cache
+	defer func() {
+		s.cache = nil
+	}()
+
+	if err := s.scan(ctx); err != nil {
+		return err // an incomplete scan would drop the files it did not reach
+	}
+	return cache.save()
+}
+
+// countCached counts a file, or takes its counts from the cache when it has not changed
+func (s *scanner) countCached(name, language string) error {
+	info, err := fs.Stat(s.FS, name)
+	if err != nil {
+		return err
+	}
+
+	// with hashing every file is read, but only changed contents are counted
+	var data []byte
+	var hash string
+	if s.cache.hash {
+		if data, err = fs.ReadFile(s.FS, name); err != nil {
+			return err
+		}
+		hash = contentHash(data)
+	}
+
+	if file, ok := s.cache.lookup(name, language, info, hash); ok {
+		s.record(file)
+		s.counted(int64(len(data)), file.Counts)
+		return nil
+	}
+
+	var r io.Reader = bytes.NewReader(data)
+	if !s.cache.hash {
+		file, err := s.FS.Open(name)
+		if err != nil {
+			return err
+		}
+		defer func(file fs.File) {
+			_ = file.Close()
+		}(file)
+		r = file
+	}
+
+	file, counted, err := s.count(name, language, r)
+	if err != nil || !counted { // binary files are sniffed again, which only reads their first block
+		return err
+	}
+	s.cache.store(language, info, hash, file)
+	return nil
+}
+
+// PruneCache removes the caches in dir of directories that no longer exist, that were not scanned for
+// longer than maxAge, or that cannot be read. A maxAge of 0 keeps caches regardless of their age.
+// It returns the number of caches removed.
+func PruneCache(dir string, maxAge time.Duration) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil // nothing was ever cached
+	} else if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+
+		if !stale(path, maxAge) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return removed, fmt.Errorf("removing cache '%s': %v", path, err)
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// stale reports whether the cache file at path is of no further use
+func stale(path string, maxAge time.Duration) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return true
+	}
+	if maxAge > 0 && time.Since(info.ModTime()) > maxAge { // rewritten on every scan
+		return true
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return true
+	}
+	var cache cacheFile
+	if err := json.Unmarshal(data, &cache); err != nil || cache.Root == "" {
+		return true
+	}
+
+	_, err = os.Stat(cache.Root)
+	return err != nil
+}
@@ -0,0 +1,169 @@
+// loc - language configuration
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// LanguageConfig is the configuration for a language
+type LanguageConfig struct {
+	SkipPatterns []string `json:"skip_patterns"`      // Patterns to skip; lines matching these patterns will not be counted
+	Extensions   []string `json:"extensions"`         // File extensions to count
+	Priority     int      `json:"priority,omitempty"` // Wins an extension shared with other languages over those with a lower priority
+
+	GeneratedHeaders []string `json:"generated_headers,omitempty"` // Patterns for lines near the start of generated files, in addition to the built-in markers
+	GeneratedFiles   []string `json:"generated_files,omitempty"`   // Patterns for the names of generated files, in addition to the built-in names
+
+	Encoding string `json:"encoding,omitempty"` // Encoding of the files, such as utf-16le or latin-1, detected when empty
+
+	Embedded []EmbeddedRegion `json:"embedded,omitempty"` // Regions of other languages, like the scripts and styles of an HTML page
+}
+
+// EmbeddedRegion is a region of a file in another language than the file, such as a <script> block, whose
+// lines are counted as that language. The first region whose start pattern matches a line is opened, the
+// first line matching its end pattern closes it.
+type EmbeddedRegion struct {
+	Language string `json:"language"` // The configured language the lines inside the region are counted as
+	Start    string `json:"start"`    // Pattern for the line opening the region, e.g. <script\b
+	End      string `json:"end"`      // Pattern for the line closing the region, e.g. </script>
+}
+
+// Config is the configuration for Loc
+type Config struct {
+	Languages map[string]LanguageConfig `json:"languages"`
+	Vendored  []string                  `json:"vendored,omitempty"` // Patterns for the slash separated paths of vendored code, in addition to the built-in list
+
+	HiddenDirs []string `json:"hidden_dirs,omitempty"` // Names of hidden directories to walk without Options.Hidden, in addition to .github, .gitlab and .circleci
+}
+
+// ConfigFile is the name of the configuration file
+const ConfigFile = "config.json"
+
+// LoadConfig reads a Loc configuration file
+func LoadConfig(path string) (*Config, error) {
+	// read the config files contents into memory
+	configFile, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// create config variable
+	var config Config
+
+	// unmarshal the config file into the config variable
+	err = json.Unmarshal(configFile, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure every shared extension goes to one language
+	if err := checkExtensions(&config); err != nil {
+		return nil, err
+	}
+
+	// make sure every pattern compiles before counting starts
+	if _, err := compileVendoredPatterns(&config); err != nil {
+		return nil, err
+	}
+	for name, langConfig := range config.Languages {
+		if err := checkEncoding(langConfig.Encoding); err != nil {
+			return nil, fmt.Errorf("language %s: %w", name, err)
+		}
+		if _, err := compileSkipPatterns(langConfig.SkipPatterns); err != nil {
+			return nil, err
+		}
+		if _, err := compileGeneratedPatterns(langConfig); err != nil {
+			return nil, err
+		}
+		if _, err := compileEmbedded(&config, langConfig.Embedded); err != nil {
+			return nil, fmt.Errorf("language %s: %w", name, err)
+		}
+	}
+
+	// return the config variable
+	return &config, nil
+}
+
+// DetectLanguage returns the name of the language a file is counted as, or an empty string if no extension matches.
+// The longest matching extension wins, and an extension shared by several languages such as .m goes to the one
+// with the highest priority. LoadConfig refuses configurations that leave such a tie, ties in other configurations
+// go to the first language by name so that the result does not change from run to run.
+func (c *Config) DetectLanguage(path string) string {
+	detected, detectedExt := "", ""
+	for name, langConfig := range c.Languages { // iterate over configured languages
+		for _, ext := range langConfig.Extensions { // iterate over the extensions for the language
+			if !strings.HasSuffix(path, ext) { // if the file does not have the extension
+				continue
+			}
+			if detected == "" || len(ext) > len(detectedExt) || (len(ext) == len(detectedExt) && c.before(name, detected)) {
+				detected, detectedExt = name, ext
+			}
+		}
+	}
+	return detected
+}
+
+// before reports whether language a wins an extension shared with language b
+func (c *Config) before(a, b string) bool {
+	if priorityA, priorityB := c.Languages[a].Priority, c.Languages[b].Priority; priorityA != priorityB {
+		return priorityA > priorityB
+	}
+	return a < b
+}
+
+// checkExtensions returns an error when an extension is shared by languages of the same priority, as the
+// language its files are counted as would only depend on the names of the languages
+func checkExtensions(config *Config) error {
+	shared := make(map[string][]string) // the languages of every extension
+	for name, langConfig := range config.Languages {
+		for _, ext := range langConfig.Extensions {
+			shared[ext] = append(shared[ext], name)
+		}
+	}
+	for ext, names := range shared {
+		top := slices.MaxFunc(names, func(a, b string) int {
+			return config.Languages[a].Priority - config.Languages[b].Priority
+		})
+		tied := slices.DeleteFunc(slices.Clone(names), func(name string) bool {
+			return config.Languages[name].Priority != config.Languages[top].Priority
+		})
+		if len(tied) > 1 {
+			slices.Sort(tied)
+			return fmt.Errorf("extension %s is shared by %s with the same priority, give one of them a higher priority", ext, strings.Join(tied, " and "))
+		}
+	}
+	return nil
+}
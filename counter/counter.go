@@ -0,0 +1,257 @@
+// loc - count lines of code in a directory or repo
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package counter counts lines of code in directories, git revisions and archives.
+//
+// A count is driven by a Config describing the languages to count: the file extensions that
+// identify each language and the skip patterns that classify lines as comments or blank lines.
+// Every other line is a line of code.
+package counter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Counts is the number of lines of each classification
+type Counts struct {
+	Code    int `json:"code"`    // Lines of code, the lines not matching any skip pattern
+	Comment int `json:"comment"` // Lines matching a skip pattern that hold more than whitespace
+	Blank   int `json:"blank"`   // Lines matching a skip pattern that only hold whitespace
+
+	Generated int `json:"generated"` // Lines of generated files, which are not code, comment or blank lines
+}
+
+// add adds the counts of other to c
+func (c *Counts) add(other Counts) {
+	c.Code += other.Code
+	c.Comment += other.Comment
+	c.Blank += other.Blank
+	c.Generated += other.Generated
+}
+
+// FileCounts are the lines of a single file
+type FileCounts struct {
+	Path     string `json:"path"`     // Slash separated path relative to the counted directory, archive or tree
+	Language string `json:"language"` // The language the file was counted as
+	Counts
+
+	LineEndings string            `json:"line_endings,omitempty"` // Style of the line endings, one of the LineEndings constants, empty without any
+	Embedded    map[string]Counts `json:"embedded,omitempty"`     // Lines of embedded languages, such as the scripts of an HTML page, which are part of Counts
+}
+
+// Report is the result of a count
+type Report struct {
+	Total     Counts            `json:"total"`              // Lines of all counted files
+	Languages map[string]Counts `json:"languages"`          // Lines per language
+	Files     []FileCounts      `json:"files,omitempty"`    // Lines per file, when Options.Files is set
+	Vendored  []string          `json:"vendored,omitempty"` // Slash separated paths of the vendored directories and files skipped
+	Binary    []string          `json:"binary,omitempty"`   // Slash separated paths of the files skipped as binary
+
+	MixedLineEndings []string `json:"mixed_line_endings,omitempty"` // Slash separated paths of the files with more than one line ending style
+	BrokenLinks      []string `json:"broken_links,omitempty"`       // Slash separated paths of the symlinks whose target is missing
+	TooLarge         []string `json:"too_large,omitempty"`          // Slash separated paths of the files skipped for being over Options.MaxFileSize
+	InvalidNotebooks []string `json:"invalid_notebooks,omitempty"`  // Slash separated paths of the notebooks skipped for not being valid JSON
+}
+
+// add adds the counts of a file in a language to the report
+func (r *Report) add(language string, counts Counts) {
+	if r.Languages == nil {
+		r.Languages = make(map[string]Counts)
+	}
+	languageCounts := r.Languages[language]
+	languageCounts.add(counts)
+	r.Languages[language] = languageCounts
+	r.Total.add(counts)
+}
+
+// Options configure a count
+type Options struct {
+	Config          *Config  // The languages to count, required
+	ExcludePatterns []string // Regex patterns for files and directories to skip
+	GitTracked      bool     // Count only files tracked by git
+	GitUntracked    bool     // With GitTracked, also count untracked files that are not ignored
+	Rev             string   // Git commit, tag or branch to count instead of the working tree
+	CacheDir        string   // Directory to keep per-file counts in, so a directory counted again only reads changed files
+	CacheHash       bool     // With CacheDir, match files on a hash of their contents instead of their size and mtime
+	Files           bool     // Record the lines of every file in Report.Files
+	CountGenerated  bool     // Count generated files like any other instead of in the generated column
+	IncludeVendored bool     // Count vendored code like vendor/ and node_modules/ instead of skipping it
+	FollowSymlinks  bool     // Walk symlinked directories, counting every file and directory once
+	MaxDepth        int      // Count files at most this many directories deep, counting the root's files as 1; 0 for no limit
+	MaxFileSize     int64    // Skip files larger than this many bytes, listing them in the report; 0 for no limit
+	Hidden          bool     // Walk hidden directories, whose names start with a dot; only configured ones are walked otherwise
+	OneFileSystem   bool     // Do not walk directories on other filesystems than the root, such as mount points
+
+	// Progress is called after every file with the progress of the count so far, e.g. to report it
+	// while a large tree is scanned. It is called from the goroutine running the count.
+	Progress func(Progress)
+}
+
+// newScanner creates a scanner for root from the options
+func (opts Options) newScanner(ctx context.Context, root string) (*scanner, error) {
+	if opts.Config == nil {
+		return nil, fmt.Errorf("no config given")
+	}
+
+	if opts.FollowSymlinks && !canFollowSymlinks {
+		return nil, fmt.Errorf("following symlinks needs device and inode numbers to detect cycles, which this platform does not have")
+	}
+	if opts.OneFileSystem && !canFollowSymlinks {
+		return nil, fmt.Errorf("staying on one filesystem needs device numbers, which this platform does not have")
+	}
+
+	s := &scanner{Config: opts.Config, Directory: root, onProgress: opts.Progress, files: opts.Files, countGenerated: opts.CountGenerated,
+		followSymlinks: opts.FollowSymlinks}
+	s.maxDepth, s.maxFileSize, s.hidden, s.oneFileSystem = opts.MaxDepth, opts.MaxFileSize, opts.Hidden, opts.OneFileSystem
+	s.hiddenDirs = hiddenDirs(opts.Config)
+
+	var err error
+	if !opts.IncludeVendored {
+		s.vendoredRegexps, err = compileVendoredPatterns(opts.Config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.ExcludePatterns) > 0 {
+		s.ExcludePatterns, err = compileExcludePatterns(opts.ExcludePatterns)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.GitTracked {
+		s.GitFiles, err = gitTrackedFiles(ctx, root, opts.GitUntracked)
+		if err != nil {
+			return nil, err
+		}
+		s.progress.FilesTotal = s.gitFileCount(s.GitFiles)
+	}
+
+	return s, nil
+}
+
+// useDir makes the scanner walk the directory at root on disk. When root is a single file only that file is walked.
+func (s *scanner) useDir(root string) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		s.FS = os.DirFS(root)
+		return nil
+	}
+
+	s.Directory = filepath.Dir(root)
+	s.FS = os.DirFS(s.Directory)
+	s.start = filepath.Base(root)
+	return nil
+}
+
+// Count counts the lines of code below root. Root is a directory, or an archive such as a .tar.gz or
+// .jar file whose members are counted without extracting it. When opts.Rev is set, root is a directory
+// in a git repository and the tree of that revision is counted instead of the working tree.
+// If ctx is cancelled the counts collected so far are returned along with ctx.Err().
+func Count(ctx context.Context, root string, opts Options) (*Report, error) {
+	s, err := opts.newScanner(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case opts.Rev != "":
+		err = s.scanRevision(ctx, opts.Rev)
+	case IsArchive(root):
+		err = s.scanArchive(ctx)
+	default:
+		if err = s.useDir(root); err != nil {
+			break
+		}
+		if opts.CacheDir != "" {
+			err = s.scanWithCache(ctx, opts.CacheDir, root, opts.CacheHash)
+		} else {
+			err = s.scan(ctx)
+		}
+	}
+
+	return s.result(ctx, err)
+}
+
+// result returns the report of a scan that ended with err. A scan stopped by ctx being cancelled or
+// timing out still returns the counts collected so far, together with the error of ctx.
+func (s *scanner) result(ctx context.Context, err error) (*Report, error) {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return &s.Report, ctxErr // a killed git process fails with its own error, report the cause
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s.Report, nil
+}
+
+// CountFS counts the lines of code in a filesystem such as an embed.FS, a zip.Reader or an fstest.MapFS.
+// Exclude patterns are matched against slash separated names relative to the root of fsys. Git tracked
+// mode and revisions need a repository on disk and are not supported.
+func CountFS(ctx context.Context, fsys fs.FS, opts Options) (*Report, error) {
+	if opts.GitTracked || opts.Rev != "" {
+		return nil, fmt.Errorf("git options need a directory on disk, use Count")
+	}
+
+	s, err := opts.newScanner(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	s.FS = fsys
+
+	return s.result(ctx, s.scan(ctx))
+}
+
+// CountReader counts the lines read from r as the given language. Embedded regions and notebooks refer to
+// other languages of the config and are not supported: the scripts of an HTML page are counted as HTML and a
+// notebook is counted as JSON text. Use CountFS, e.g. with a fstest.MapFS, to count them the way Count does.
+func CountReader(lang LanguageConfig, r io.Reader) (Counts, error) {
+	skipRegexps, err := compileSkipPatterns(lang.SkipPatterns)
+	if err != nil {
+		return Counts{}, err
+	}
+	body, _, binary := decode(r, lang.Encoding)
+	if binary { // a binary stream has no lines
+		return Counts{}, nil
+	}
+	counts, _, err := countReader(body, skipRegexps)
+	return counts, err
+}
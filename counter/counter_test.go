@@ -0,0 +1,2817 @@
+// loc counter tests
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
+)
+
+// testFiles are the files of the test project
+var testFiles = map[string]string{
+	"main.go":                       "package main\n\nfunc main() {\n\tprintln(\"hello\")\n}\n",
+	"src/utils.go":                  "package src\n\nfunc Add(a, b int) int {\n\treturn a + b\n}\n",
+	"src/utils_test.go":             "package src\n\nimport \"testing\"\n\nfunc TestAdd(t *testing.T) {\n\t// test code\n}\n",
+	"src/tests/integration.go":      "package tests\n\n// integration test\nfunc TestIntegration() {\n}\n",
+	"app.spec.ts":                   "describe('app', () => {\n\tit('works', () => {\n\t\t// test\n\t});\n});\n",
+	"component.test.js":             "test('component', () => {\n\t// test code\n});\n",
+	"build/output.go":               "// generated file\npackage main\n\nvar Generated = true\n",
+	"gen/models.go":                 "// Auto-generated file\npackage gen\n\ntype Model struct{}\n",
+	"node_modules/package/index.js": "module.exports = {};\n",
+	".git/config":                   "[core]\n\trepositoryformatversion = 0\n",
+	"README.md":                     "# Test Project\n\nThis is a test.\n",
+}
+
+// testConfig is the configuration used to count the test project
+var testConfig = &Config{
+	Languages: map[string]LanguageConfig{
+		"go": {
+			Extensions:   []string{".go"},
+			SkipPatterns: []string{`^\s*//`, `^\s*$`}, // Skip comments and empty lines
+		},
+		"typescript": {
+			Extensions:   []string{".ts"},
+			SkipPatterns: []string{`^\s*//`, `^\s*$`},
+		},
+		"javascript": {
+			Extensions:   []string{".js"},
+			SkipPatterns: []string{`^\s*//`, `^\s*$`},
+		},
+		"markdown": {
+			Extensions:   []string{".md"},
+			SkipPatterns: []string{`^\s*$`},
+		},
+	},
+}
+
+// setupTestFS returns the test project as an in-memory filesystem
+func setupTestFS() fstest.MapFS {
+	fsys := make(fstest.MapFS)
+	for file, content := range testFiles {
+		fsys[file] = &fstest.MapFile{Data: []byte(content), Mode: 0644}
+	}
+	return fsys
+}
+
+// setupTestDirectory writes files, such as the test project, to a temporary directory for tests that need
+// files on disk
+func setupTestDirectory(t *testing.T, files map[string]string) string {
+	tempDir := t.TempDir()
+
+	for file, content := range files {
+		filePath := filepath.Join(tempDir, file)
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err != nil {
+			t.Fatalf("Failed to create directory for file %s: %v", file, err)
+		}
+
+		err = os.WriteFile(filePath, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Failed to create file %s: %v", file, err)
+		}
+	}
+
+	return tempDir
+}
+
+// commitTestDirectory commits every file in dir to a new git repository, so its tree can be counted as a revision
+func commitTestDirectory(t *testing.T, dir string) {
+	runGit(t, dir, "init", "--quiet")
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "commit", "--quiet", "-m", "files")
+}
+
+// checkCountModes counts dir on disk, twice with a cache and as a committed revision, and calls check with every
+// report, as files must be counted the same however they are read
+func checkCountModes(t *testing.T, dir string, opts Options, check func(name string, report *Report)) {
+	t.Helper()
+
+	report, err := Count(context.Background(), dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	check("directory", report)
+
+	cached := opts
+	cached.CacheDir = t.TempDir()
+	for _, run := range []string{"first cached run", "second cached run"} {
+		report, err := Count(context.Background(), dir, cached)
+		if err != nil {
+			t.Fatalf("Failed to count: %v", err)
+		}
+		check(run, report)
+	}
+
+	commitTestDirectory(t, dir)
+	revision := opts
+	revision.Rev = "HEAD"
+	report, err = Count(context.Background(), dir, revision)
+	if err != nil {
+		t.Fatalf("Failed to count revision: %v", err)
+	}
+	check("revision", report)
+}
+
+func TestExcludePatterns(t *testing.T) {
+	tests := []struct {
+		name            string
+		excludePatterns []string
+		expectedFiles   []string
+		excludedFiles   []string
+	}{
+		{
+			name:            "No exclusions",
+			excludePatterns: []string{},
+			expectedFiles: []string{
+				"main.go",
+				"src/utils.go",
+				"src/utils_test.go",
+				"src/tests/integration.go",
+				"app.spec.ts",
+				"component.test.js",
+				"build/output.go",
+				"gen/models.go",
+				"node_modules/package/index.js",
+				"README.md",
+			},
+		},
+		{
+			name:            "Exclude test files",
+			excludePatterns: []string{`.*_test\.go$`, `.*\.spec\.ts$`, `.*\.test\.js$`},
+			expectedFiles: []string{
+				"main.go",
+				"src/utils.go",
+				"src/tests/integration.go",
+				"build/output.go",
+				"gen/models.go",
+				"node_modules/package/index.js",
+				"README.md",
+			},
+			excludedFiles: []string{
+				"src/utils_test.go",
+				"app.spec.ts",
+				"component.test.js",
+			},
+		},
+		{
+			name:            "Exclude directories",
+			excludePatterns: []string{`node_modules/.*`, `\.git/.*`, `build/.*`},
+			expectedFiles: []string{
+				"main.go",
+				"src/utils.go",
+				"src/utils_test.go",
+				"src/tests/integration.go",
+				"app.spec.ts",
+				"component.test.js",
+				"gen/models.go",
+				"README.md",
+			},
+			excludedFiles: []string{
+				"build/output.go",
+				"node_modules/package/index.js",
+			},
+		},
+		{
+			name:            "Exclude generated and test files",
+			excludePatterns: []string{`gen/.*`, `.*_test\.go$`, `tests/.*`},
+			expectedFiles: []string{
+				"main.go",
+				"src/utils.go",
+				"app.spec.ts",
+				"component.test.js",
+				"build/output.go",
+				"node_modules/package/index.js",
+				"README.md",
+			},
+			excludedFiles: []string{
+				"gen/models.go",
+				"src/utils_test.go",
+				"src/tests/integration.go",
+			},
+		},
+		{
+			name: "Complex exclusion patterns",
+			excludePatterns: []string{
+				`.*_test\.go$`,  // Go test files
+				`.*\.spec\.ts$`, // TypeScript spec files
+				`.*\.test\.js$`, // JavaScript test files
+				`/tests/`,       // Test directories
+				`node_modules/`, // Node modules
+				`build/`,        // Build directory
+			},
+			expectedFiles: []string{
+				"main.go",
+				"src/utils.go",
+				"gen/models.go",
+				"README.md",
+			},
+			excludedFiles: []string{
+				"src/utils_test.go",
+				"src/tests/integration.go",
+				"app.spec.ts",
+				"component.test.js",
+				"build/output.go",
+				"node_modules/package/index.js",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &scanner{
+				Config: testConfig,
+				FS:     setupTestFS(),
+			}
+
+			if len(tt.excludePatterns) > 0 {
+				compiledPatterns, err := compileExcludePatterns(tt.excludePatterns)
+				if err != nil {
+					t.Fatalf("Failed to compile exclude patterns: %v", err)
+				}
+				s.ExcludePatterns = compiledPatterns
+			}
+
+			processedFiles := make(map[string]bool)
+
+			err := s.walk(context.Background(), func(name string) error {
+				processedFiles[name] = true
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Failed to walk filesystem: %v", err)
+			}
+
+			// Check that expected files are processed
+			for _, expectedFile := range tt.expectedFiles {
+				if !processedFiles[expectedFile] {
+					t.Errorf("Expected file %s was not processed", expectedFile)
+				}
+			}
+
+			// Check that excluded files are not processed
+			for _, excludedFile := range tt.excludedFiles {
+				if processedFiles[excludedFile] {
+					t.Errorf("Excluded file %s was processed", excludedFile)
+				}
+			}
+
+			// Also test the actual line counting
+			s.Total.Code = 0
+			err = s.scan(context.Background())
+			if err != nil {
+				t.Fatalf("Failed to scan directory: %v", err)
+			}
+
+			if s.Total.Code == 0 && len(tt.expectedFiles) > 0 {
+				t.Error("Expected some lines to be counted but got 0")
+			}
+
+			t.Logf("Test %s: Processed %d files, counted %d lines",
+				tt.name, len(processedFiles), s.Total.Code)
+		})
+	}
+}
+
+func TestShouldExcludeFile(t *testing.T) {
+	s := &scanner{
+		Directory: "/project",
+	}
+
+	patterns := []string{
+		`.*_test\.go$`,
+		`node_modules/.*`,
+		`\.git/.*`,
+		`gen/.*`,
+	}
+
+	compiledPatterns, err := compileExcludePatterns(patterns)
+	if err != nil {
+		t.Fatalf("Failed to compile patterns: %v", err)
+	}
+	s.ExcludePatterns = compiledPatterns
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"/project/main.go", false},
+		{"/project/src/utils.go", false},
+		{"/project/src/utils_test.go", true},
+		{"/project/node_modules/package/index.js", true},
+		{"/project/.git/config", true},
+		{"/project/gen/models.go", true},
+		{"/project/build/output.go", false},
+		{"/project/app.spec.ts", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			result := s.shouldExcludeFile(tt.path)
+			if result != tt.expected {
+				t.Errorf("shouldExcludeFile(%s) = %v, expected %v", tt.path, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCompileExcludePatterns(t *testing.T) {
+	tests := []struct {
+		name        string
+		patterns    []string
+		expectError bool
+	}{
+		{
+			name:        "Valid patterns",
+			patterns:    []string{`.*_test\.go$`, `node_modules/.*`},
+			expectError: false,
+		},
+		{
+			name:        "Invalid regex",
+			patterns:    []string{`[`}, // Invalid regex
+			expectError: true,
+		},
+		{
+			name:        "Empty patterns",
+			patterns:    []string{},
+			expectError: false,
+		},
+		{
+			name:        "Complex patterns",
+			patterns:    []string{`(test|spec)`, `\.(git|build)/`, `^gen/.*\.go$`},
+			expectError: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compiled, err := compileExcludePatterns(tt.patterns)
+
+			if tt.expectError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+			} else {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				if len(compiled) != len(tt.patterns) {
+					t.Errorf("Expected %d compiled patterns, got %d", len(tt.patterns), len(compiled))
+				}
+			}
+		})
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	config := &Config{Languages: map[string]LanguageConfig{
+		"c":           {Extensions: []string{".c", ".h"}, Priority: 2},
+		"cpp":         {Extensions: []string{".cpp", ".hpp", ".h"}},
+		"objective-c": {Extensions: []string{".m", ".h"}, Priority: 1},
+		"matlab":      {Extensions: []string{".m"}},
+		"sql":         {Extensions: []string{".sql"}},
+		"tsql":        {Extensions: []string{".sql"}, Priority: 1},
+		"typescript":  {Extensions: []string{".ts"}},
+		"definitions": {Extensions: []string{".d.ts"}},
+	}}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"main.c", "c"},
+		{"header.h", "c"},                // shared extension, highest priority
+		{"AppDelegate.m", "objective-c"}, // not matlab, which has no priority
+		{"schema.sql", "tsql"},
+		{"main.cpp", "cpp"},
+		{"index.d.ts", "definitions"}, // longest extension wins
+		{"index.ts", "typescript"},
+		{"README.md", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if language := config.DetectLanguage(tt.path); language != tt.expected {
+				t.Errorf("DetectLanguage(%s) = %q, expected %q", tt.path, language, tt.expected)
+			}
+		})
+	}
+
+	// a shared extension without a winner is caught when the config is loaded
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	shared := `{"languages": {"objective-c": {"extensions": [".m"]}, "matlab": {"extensions": [".m"]}}}`
+	if err := os.WriteFile(configPath, []byte(shared), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := LoadConfig(configPath); err == nil || !strings.Contains(err.Error(), "matlab and objective-c") {
+		t.Errorf("Expected an error for .m shared by matlab and objective-c, got %v", err)
+	}
+
+	// the configuration shipped with loc resolves every shared extension
+	shipped, err := LoadConfig(filepath.Join("..", ConfigFile))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	for path, expected := range map[string]string{"main.m": "objective-c", "unit.pas": "pascal", "schema.sql": "tsql", "header.h": "c"} {
+		if language := shipped.DetectLanguage(path); language != expected {
+			t.Errorf("DetectLanguage(%s) = %q with %s, expected %q", path, language, ConfigFile, expected)
+		}
+	}
+}
+
+// runGit runs a git command in dir with a fixed identity and fails the test if it fails
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	args = append([]string{"-C", dir, "-c", "user.name=loc", "-c", "user.email=loc@example.com"}, args...)
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestGitTrackedFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	testDir := setupTestDirectory(t, testFiles)
+
+	// Track the sources, leave the build output untracked and ignore node_modules
+	runGit(t, testDir, "init", "-q")
+	err := os.WriteFile(filepath.Join(testDir, ".gitignore"), []byte("node_modules/\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write .gitignore: %v", err)
+	}
+	runGit(t, testDir, "add", "main.go", "src", "gen")
+
+	tests := []struct {
+		name             string
+		includeUntracked bool
+		expectedFiles    []string
+		excludedFiles    []string
+	}{
+		{
+			name:          "Tracked only",
+			expectedFiles: []string{"main.go", "src/utils.go", "src/tests/integration.go", "gen/models.go"},
+			excludedFiles: []string{"build/output.go", "app.spec.ts", "node_modules/package/index.js", ".git/config"},
+		},
+		{
+			name:             "Tracked and untracked",
+			includeUntracked: true,
+			expectedFiles:    []string{"main.go", "src/utils.go", "build/output.go", "app.spec.ts"},
+			excludedFiles:    []string{"node_modules/package/index.js", ".git/config"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := gitTrackedFiles(context.Background(), testDir, tt.includeUntracked)
+			if err != nil {
+				t.Fatalf("Failed to list git files: %v", err)
+			}
+
+			s := &scanner{Directory: testDir, GitFiles: files}
+
+			for _, expectedFile := range tt.expectedFiles {
+				if !s.isGitFile(expectedFile) {
+					t.Errorf("Expected file %s to be counted", expectedFile)
+				}
+			}
+
+			for _, excludedFile := range tt.excludedFiles {
+				if s.isGitFile(excludedFile) {
+					t.Errorf("Expected file %s to be skipped", excludedFile)
+				}
+			}
+		})
+	}
+
+	// Only the tracked go files should be counted
+	files, err := gitTrackedFiles(context.Background(), testDir, false)
+	if err != nil {
+		t.Fatalf("Failed to list git files: %v", err)
+	}
+	s := &scanner{
+		FS:        os.DirFS(testDir),
+		Directory: testDir,
+		GitFiles:  files,
+		Config: &Config{Languages: map[string]LanguageConfig{
+			"go": {Extensions: []string{".go"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+		}},
+	}
+	if err := s.scan(context.Background()); err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+
+	// main.go: 4, src/utils.go: 4, src/utils_test.go: 4, src/tests/integration.go: 3, gen/models.go: 2
+	if s.Total.Code != 17 {
+		t.Errorf("Expected 17 lines, got %d", s.Total.Code)
+	}
+}
+
+func TestScanRevision(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	testDir := setupTestDirectory(t, testFiles)
+
+	goConfig := &Config{Languages: map[string]LanguageConfig{
+		"go": {Extensions: []string{".go"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+	}}
+
+	// Commit the sources and tag them, then grow main.go in a later commit and in the working tree
+	runGit(t, testDir, "init", "-q")
+	runGit(t, testDir, "add", "main.go", "src", "gen")
+	runGit(t, testDir, "commit", "-q", "-m", "initial")
+	runGit(t, testDir, "tag", "v1.0.0")
+
+	err := os.WriteFile(filepath.Join(testDir, "main.go"), []byte("package main\n\nfunc main() {\n}\n\nfunc other() {\n}\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write main.go: %v", err)
+	}
+	runGit(t, testDir, "commit", "-q", "-a", "-m", "grow main.go")
+	err = os.WriteFile(filepath.Join(testDir, "main.go"), []byte("package main\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write main.go: %v", err)
+	}
+
+	tests := []struct {
+		name            string
+		directory       string
+		rev             string
+		excludePatterns []string
+		expected        int
+	}{
+		// main.go: 4, src/utils.go: 4, src/utils_test.go: 4, src/tests/integration.go: 3, gen/models.go: 2
+		{name: "Tag", directory: testDir, rev: "v1.0.0", expected: 17},
+		// main.go: 5 after the second commit
+		{name: "Branch head", directory: testDir, rev: "HEAD", expected: 18},
+		{name: "Exclude directory", directory: testDir, rev: "v1.0.0", excludePatterns: []string{`^gen$`}, expected: 15},
+		{name: "Subdirectory", directory: filepath.Join(testDir, "src"), rev: "v1.0.0", expected: 11},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &scanner{Directory: tt.directory, Config: goConfig}
+
+			if len(tt.excludePatterns) > 0 {
+				s.ExcludePatterns, err = compileExcludePatterns(tt.excludePatterns)
+				if err != nil {
+					t.Fatalf("Failed to compile exclude patterns: %v", err)
+				}
+			}
+
+			if err := s.scanRevision(context.Background(), tt.rev); err != nil {
+				t.Fatalf("Failed to scan revision: %v", err)
+			}
+
+			if s.Total.Code != tt.expected {
+				t.Errorf("Expected %d lines, got %d", tt.expected, s.Total.Code)
+			}
+		})
+	}
+
+	// The working copy must be left untouched
+	content, err := os.ReadFile(filepath.Join(testDir, "main.go"))
+	if err != nil {
+		t.Fatalf("Failed to read main.go: %v", err)
+	}
+	if string(content) != "package main\n" {
+		t.Errorf("Working copy was modified: %q", content)
+	}
+
+	s := &scanner{Directory: testDir, Config: goConfig}
+	if err := s.scanRevision(context.Background(), "does-not-exist"); err == nil {
+		t.Error("Expected an error for an unknown revision")
+	}
+}
+
+// commitAt commits all changes in dir with the given author and committer date
+func commitAt(t *testing.T, dir, date string) {
+	t.Helper()
+
+	runGit(t, dir, "add", "-A")
+	cmd := exec.Command("git", "-C", dir, "-c", "user.name=loc", "-c", "user.email=loc@example.com", "commit", "-q", "-m", date)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git commit failed: %v\n%s", err, out)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	testDir, err := os.MkdirTemp("", "loc-history-")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(testDir)
+
+	writeFile := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(testDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	// Grow the repository over three months, with two commits in February
+	runGit(t, testDir, "init", "-q")
+	writeFile("main.go", "package main\n\nfunc main() {\n}\n")
+	commitAt(t, testDir, "2024-01-15T12:00:00Z")
+	writeFile("app.js", "// app\nfunction app() {\n}\n")
+	commitAt(t, testDir, "2024-02-01T12:00:00Z")
+	writeFile("util.go", "package main\n\nfunc util() {\n}\n")
+	commitAt(t, testDir, "2024-02-20T12:00:00Z")
+	writeFile("main.go", "package main\n")
+	commitAt(t, testDir, "2024-03-10T12:00:00Z")
+
+	s := &scanner{
+		Directory: testDir,
+		Config: &Config{Languages: map[string]LanguageConfig{
+			"go":         {Extensions: []string{".go"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+			"javascript": {Extensions: []string{".js"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		since    string
+		every    string
+		expected []map[string]int
+	}{
+		{
+			name:  "Monthly",
+			every: "month",
+			expected: []map[string]int{
+				{"go": 3},
+				{"go": 6, "javascript": 2},
+				{"go": 4, "javascript": 2},
+			},
+		},
+		{
+			name:  "Every commit since February",
+			since: "2024-02-01T00:00:00Z",
+			every: "commit",
+			expected: []map[string]int{
+				{"go": 3, "javascript": 2},
+				{"go": 6, "javascript": 2},
+				{"go": 4, "javascript": 2},
+			},
+		},
+		{
+			name:  "Yearly",
+			every: "year",
+			expected: []map[string]int{
+				{"go": 4, "javascript": 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commits, err := gitHistory(context.Background(), testDir, "HEAD", tt.since, "")
+			if err != nil {
+				t.Fatalf("Failed to list history: %v", err)
+			}
+
+			commits, err = sampleCommits(commits, tt.every)
+			if err != nil {
+				t.Fatalf("Failed to sample commits: %v", err)
+			}
+
+			samples, err := s.history(context.Background(), commits)
+			if err != nil {
+				t.Fatalf("Failed to count history: %v", err)
+			}
+
+			if len(samples) != len(tt.expected) {
+				t.Fatalf("Expected %d samples, got %d", len(tt.expected), len(samples))
+			}
+			for i, expected := range tt.expected {
+				total := 0
+				for language, lines := range expected {
+					total += lines
+					if samples[i].Languages[language] != lines {
+						t.Errorf("Sample %d: expected %d %s lines, got %d", i, lines, language, samples[i].Languages[language])
+					}
+				}
+				if samples[i].TotalLines != total {
+					t.Errorf("Sample %d: expected %d total lines, got %d", i, total, samples[i].TotalLines)
+				}
+				if i > 0 && samples[i].Date.Before(samples[i-1].Date) {
+					t.Errorf("Samples are not in chronological order")
+				}
+			}
+		})
+	}
+
+	if _, err := sampleCommits(nil, "fortnight"); err == nil {
+		t.Error("Expected an error for an invalid interval")
+	}
+
+	// The public entry point samples monthly by default
+	samples, err := History(context.Background(), testDir, HistoryOptions{Options: Options{Config: s.Config}})
+	if err != nil {
+		t.Fatalf("Failed to build history: %v", err)
+	}
+	if len(samples) != 3 || samples[2].TotalLines != 6 || samples[2].Languages["go"] != 4 {
+		t.Errorf("Unexpected history %+v", samples)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     []string
+		expected LineDelta
+	}{
+		{name: "Equal", a: []string{"a", "b"}, b: []string{"a", "b"}, expected: LineDelta{}},
+		{name: "Added", a: nil, b: []string{"a", "b"}, expected: LineDelta{Added: 2}},
+		{name: "Removed", a: []string{"a", "b"}, b: nil, expected: LineDelta{Removed: 2}},
+		{name: "Modified in place", a: []string{"a", "b", "c"}, b: []string{"a", "x", "c"}, expected: LineDelta{Modified: 1}},
+		{name: "Separate hunks", a: []string{"x", "a", "b"}, b: []string{"a", "b", "y"}, expected: LineDelta{Added: 1, Removed: 1}},
+		{name: "Uneven hunk", a: []string{"a", "b", "c"}, b: []string{"a", "x", "y", "z", "c"}, expected: LineDelta{Added: 2, Modified: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if delta := diffLines(tt.a, tt.b); delta != tt.expected {
+				t.Errorf("diffLines(%v, %v) = %+v, expected %+v", tt.a, tt.b, delta, tt.expected)
+			}
+		})
+	}
+
+	// The lines kept must form a longest common subsequence, compared against a dynamic programming solution
+	lcsLength := func(a, b []string) int {
+		table := make([][]int, len(a)+1)
+		for i := range table {
+			table[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					table[i][j] = table[i+1][j+1] + 1
+				} else {
+					table[i][j] = max(table[i+1][j], table[i][j+1])
+				}
+			}
+		}
+		return table[0][0]
+	}
+
+	random := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, random.Intn(20))
+		for i := range lines {
+			lines[i] = string(rune('a' + random.Intn(4)))
+		}
+		return lines
+	}
+
+	for i := 0; i < 500; i++ {
+		a, b := randomLines(), randomLines()
+		keptA, keptB := make([]bool, len(a)), make([]bool, len(b))
+		markCommon(a, b, keptA, keptB)
+
+		var commonA, commonB []string
+		for j, kept := range keptA {
+			if kept {
+				commonA = append(commonA, a[j])
+			}
+		}
+		for j, kept := range keptB {
+			if kept {
+				commonB = append(commonB, b[j])
+			}
+		}
+
+		if strings.Join(commonA, "") != strings.Join(commonB, "") || len(commonA) != lcsLength(a, b) {
+			t.Fatalf("markCommon(%v, %v) kept %v and %v, expected a common subsequence of length %d",
+				a, b, commonA, commonB, lcsLength(a, b))
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	testDir, err := os.MkdirTemp("", "loc-diff-")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(testDir)
+
+	writeFile := func(name, content string) {
+		path := filepath.Join(testDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory for %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	// The base has main.go and old.js, the head changes main.go, removes old.js and adds gen/new.go
+	writeFile("main.go", "// main\npackage main\n\nfunc main() {\n\tprintln(\"a\")\n}\n")
+	writeFile("old.js", "// old\nfunction old() {\n}\n")
+	writeFile("README.md", "# readme\n")
+	runGit(t, testDir, "init", "-q")
+	commitAt(t, testDir, "2024-01-01T12:00:00Z")
+	runGit(t, testDir, "tag", "base")
+
+	writeFile("main.go", "// main entry point\npackage main\n\n\nfunc main() {\n\tprintln(\"b\")\n\tprintln(\"c\")\n}\n")
+	writeFile("gen/new.go", "package gen\n")
+	writeFile("README.md", "# readme\n\nmore\n")
+	if err := os.Remove(filepath.Join(testDir, "old.js")); err != nil {
+		t.Fatalf("Failed to remove old.js: %v", err)
+	}
+	commitAt(t, testDir, "2024-01-02T12:00:00Z")
+
+	s := &scanner{
+		Directory: testDir,
+		Config: &Config{Languages: map[string]LanguageConfig{
+			"go":         {Extensions: []string{".go"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+			"javascript": {Extensions: []string{".js"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+		}},
+	}
+
+	catFile, err := newGitCatFile(context.Background(), testDir)
+	if err != nil {
+		t.Fatalf("Failed to start git cat-file: %v", err)
+	}
+	defer func(catFile *gitCatFile) {
+		_ = catFile.close()
+	}(catFile)
+
+	oldFiles, err := s.treeFiles(context.Background(), catFile, "base")
+	if err != nil {
+		t.Fatalf("Failed to list base files: %v", err)
+	}
+	newFiles, err := s.treeFiles(context.Background(), catFile, "HEAD")
+	if err != nil {
+		t.Fatalf("Failed to list head files: %v", err)
+	}
+
+	report, err := s.diff(oldFiles, newFiles)
+	if err != nil {
+		t.Fatalf("Failed to diff: %v", err)
+	}
+
+	expected := []FileDiff{
+		{Path: "gen/new.go", Language: "go", Status: "added", DiffCounts: DiffCounts{Code: LineDelta{Added: 1}}},
+		{Path: "main.go", Language: "go", Status: "modified", DiffCounts: DiffCounts{
+			Code:    LineDelta{Added: 1, Modified: 1},
+			Comment: LineDelta{Modified: 1},
+			Blank:   LineDelta{Added: 1},
+		}},
+		{Path: "old.js", Language: "javascript", Status: "removed", DiffCounts: DiffCounts{
+			Code:    LineDelta{Removed: 2},
+			Comment: LineDelta{Removed: 1},
+		}},
+	}
+	if len(report.Files) != len(expected) {
+		t.Fatalf("Expected %d changed files, got %+v", len(expected), report.Files)
+	}
+	for i, file := range expected {
+		if !reflect.DeepEqual(report.Files[i], file) {
+			t.Errorf("Expected %+v, got %+v", file, report.Files[i])
+		}
+	}
+	if report.Languages["go"].Code != (LineDelta{Added: 2, Modified: 1}) {
+		t.Errorf("Unexpected go delta %+v", report.Languages["go"])
+	}
+	if report.Total.Code != (LineDelta{Added: 2, Removed: 2, Modified: 1}) {
+		t.Errorf("Unexpected total delta %+v", report.Total)
+	}
+
+	// Comparing a checkout of the base against the working tree gives the same result, minus what is excluded
+	baseDir, err := os.MkdirTemp("", "loc-diff-base-")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(baseDir)
+	runGit(t, testDir, "--work-tree="+baseDir, "checkout", "base", "--", ".")
+	runGit(t, testDir, "checkout", "-q", "HEAD", "--", ".")
+
+	report, err = DiffDirs(context.Background(), baseDir, testDir, Options{
+		Config:          s.Config,
+		ExcludePatterns: []string{`^gen$`, `\.git$`},
+	})
+	if err != nil {
+		t.Fatalf("Failed to diff directories: %v", err)
+	}
+	if !reflect.DeepEqual(report.Files, expected[1:]) {
+		t.Errorf("Unexpected directory diff %+v", report.Files)
+	}
+}
+
+func TestNormalizeRepoURL(t *testing.T) {
+	localDir := t.TempDir()
+
+	tests := []struct {
+		repo        string
+		expected    string
+		expectError bool
+	}{
+		{repo: "github.com/owner/repo", expected: "https://github.com/owner/repo"},
+		{repo: "https://github.com/owner/repo.git", expected: "https://github.com/owner/repo.git"},
+		{repo: "ssh://git@example.com/owner/repo.git", expected: "ssh://git@example.com/owner/repo.git"},
+		{repo: "git@github.com:owner/repo.git", expected: "git@github.com:owner/repo.git"},
+		{repo: "file:///srv/git/repo.git", expected: "file:///srv/git/repo.git"},
+		{repo: localDir, expected: "file://" + filepath.ToSlash(localDir)},
+		{repo: "repo", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.repo, func(t *testing.T) {
+			repoURL, err := NormalizeRepoURL(tt.repo)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected an error, got %q", repoURL)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if repoURL != tt.expected {
+				t.Errorf("NormalizeRepoURL(%s) = %q, expected %q", tt.repo, repoURL, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCloneRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	// A local bare repository stands in for the remote
+	workDir := t.TempDir()
+	writeFile := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(workDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	runGit(t, workDir, "init", "-q", "-b", "main")
+	writeFile("v1.go", "package main\n")
+	commitAt(t, workDir, "2024-01-01T12:00:00Z")
+	runGit(t, workDir, "tag", "v1.0.0")
+	firstCommit := runGit(t, workDir, "rev-parse", "HEAD")
+	writeFile("v2.go", "package main\n")
+	commitAt(t, workDir, "2024-01-02T12:00:00Z")
+	runGit(t, workDir, "checkout", "-q", "-b", "feature")
+	writeFile("feature.go", "package main\n")
+	commitAt(t, workDir, "2024-01-03T12:00:00Z")
+	runGit(t, workDir, "checkout", "-q", "main")
+
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	runGit(t, workDir, "clone", "-q", "--bare", workDir, remote)
+
+	tests := []struct {
+		name          string
+		opts          CloneOptions
+		expectedFiles []string
+		missingFiles  []string
+		shallow       bool
+	}{
+		{name: "Default branch", opts: CloneOptions{Depth: 1}, expectedFiles: []string{"v1.go", "v2.go"}, missingFiles: []string{"feature.go"}, shallow: true},
+		{name: "Full history", opts: CloneOptions{}, expectedFiles: []string{"v1.go", "v2.go"}},
+		{name: "Branch", opts: CloneOptions{Ref: "feature", Depth: 1}, expectedFiles: []string{"feature.go"}, shallow: true},
+		{name: "Tag", opts: CloneOptions{Ref: "v1.0.0", Depth: 1}, expectedFiles: []string{"v1.go"}, missingFiles: []string{"v2.go"}, shallow: true},
+		{name: "Commit", opts: CloneOptions{Ref: firstCommit}, expectedFiles: []string{"v1.go"}, missingFiles: []string{"v2.go"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := Clone(context.Background(), remote, tt.opts)
+			if err != nil {
+				t.Fatalf("Failed to clone: %v", err)
+			}
+			defer func(path string) {
+				_ = os.RemoveAll(path)
+			}(dir)
+
+			for _, file := range tt.expectedFiles {
+				if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+					t.Errorf("Expected %s to be checked out", file)
+				}
+			}
+			for _, file := range tt.missingFiles {
+				if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+					t.Errorf("Expected %s not to be checked out", file)
+				}
+			}
+
+			if shallow := runGit(t, dir, "rev-parse", "--is-shallow-repository"); shallow != strconv.FormatBool(tt.shallow) {
+				t.Errorf("Expected shallow %v, got %s", tt.shallow, shallow)
+			}
+		})
+	}
+
+	_, err := Clone(context.Background(), remote, CloneOptions{Ref: "does-not-exist"})
+	if err == nil {
+		t.Fatal("Expected an error for an unknown ref")
+	}
+	if !strings.HasPrefix(err.Error(), "git fetch: ") { // the step that failed, not the -C flag
+		t.Errorf("Expected the error to name git fetch, got %v", err)
+	}
+}
+
+func TestScanArchive(t *testing.T) {
+	members := map[string]string{
+		"release/main.go":                       "package main\n\nfunc main() {\n}\n",
+		"release/src/utils_test.go":             "package src\n\n// test\nfunc TestAdd() {\n}\n",
+		"release/node_modules/package/index.js": "module.exports = {};\n",
+		"release/README.md":                     "# Release\n",
+	}
+
+	tempDir := t.TempDir()
+
+	// Write the members as a tar.gz and as a zip archive
+	tarPath := filepath.Join(tempDir, "release.tar.gz")
+	tarFile, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatalf("Failed to create tar file: %v", err)
+	}
+	gzipWriter := gzip.NewWriter(tarFile)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, dir := range []string{"release/", "release/src/"} {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+	}
+	for name, content := range members {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if _, err := tarWriter.Write([]byte(content)); err != nil {
+			t.Fatalf("Failed to write tar member: %v", err)
+		}
+	}
+	for _, closer := range []io.Closer{tarWriter, gzipWriter, tarFile} {
+		if err := closer.Close(); err != nil {
+			t.Fatalf("Failed to close tar file: %v", err)
+		}
+	}
+
+	zipPath := filepath.Join(tempDir, "release.jar")
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to create zip file: %v", err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	for name, content := range members {
+		member, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to create zip member: %v", err)
+		}
+		if _, err := member.Write([]byte(content)); err != nil {
+			t.Fatalf("Failed to write zip member: %v", err)
+		}
+	}
+	for _, closer := range []io.Closer{zipWriter, zipFile} {
+		if err := closer.Close(); err != nil {
+			t.Fatalf("Failed to close zip file: %v", err)
+		}
+	}
+
+	config := &Config{Languages: map[string]LanguageConfig{
+		"go":         {Extensions: []string{".go"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+		"javascript": {Extensions: []string{".js"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+	}}
+
+	tests := []struct {
+		name            string
+		archive         string
+		excludePatterns []string
+		expected        int
+	}{
+		{name: "tar.gz", archive: tarPath, expected: 7},
+		{name: "jar", archive: zipPath, expected: 7},
+		{name: "tar.gz with exclusions", archive: tarPath, excludePatterns: []string{`_test\.go$`, `^release/node_modules$`}, expected: 3},
+		{name: "jar with exclusions", archive: zipPath, excludePatterns: []string{`_test\.go$`, `^release/node_modules$`}, expected: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if archiveFormat(tt.archive) == "" {
+				t.Fatalf("Expected %s to be recognised as an archive", tt.archive)
+			}
+
+			s := &scanner{Directory: tt.archive, Config: config}
+			if len(tt.excludePatterns) > 0 {
+				s.ExcludePatterns, err = compileExcludePatterns(tt.excludePatterns)
+				if err != nil {
+					t.Fatalf("Failed to compile exclude patterns: %v", err)
+				}
+			}
+
+			if err := s.scanArchive(context.Background()); err != nil {
+				t.Fatalf("Failed to scan archive: %v", err)
+			}
+			if s.Total.Code != tt.expected {
+				t.Errorf("Expected %d lines, got %d", tt.expected, s.Total.Code)
+			}
+		})
+	}
+}
+
+func TestCountFS(t *testing.T) {
+	report, err := CountFS(context.Background(), setupTestFS(), Options{
+		Config:          testConfig,
+		ExcludePatterns: []string{`^node_modules$`, `_test\.go$`},
+	})
+	if err != nil {
+		t.Fatalf("Failed to count filesystem: %v", err)
+	}
+
+	// main.go: 4, src/utils.go: 4, src/tests/integration.go: 3, build/output.go: 2, gen/models.go: 2
+	expected := map[string]Counts{
+		"go":         {Code: 15, Comment: 3, Blank: 5},
+		"typescript": {Code: 4, Comment: 1},
+		"javascript": {Code: 2, Comment: 1},
+		"markdown":   {Code: 2, Blank: 1},
+	}
+	for language, counts := range expected {
+		if report.Languages[language] != counts {
+			t.Errorf("Expected %s counts %+v, got %+v", language, counts, report.Languages[language])
+		}
+	}
+	if report.Total.Code != 23 {
+		t.Errorf("Expected 23 lines of code, got %d", report.Total.Code)
+	}
+
+	// A zip archive is a filesystem too
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for name, content := range testFiles {
+		member, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to create zip member: %v", err)
+		}
+		if _, err := member.Write([]byte(content)); err != nil {
+			t.Fatalf("Failed to write zip member: %v", err)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatalf("Failed to close zip: %v", err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Failed to read zip: %v", err)
+	}
+
+	zipReport, err := CountFS(context.Background(), zipReader, Options{
+		Config:          testConfig,
+		ExcludePatterns: []string{`^node_modules$`, `_test\.go$`},
+	})
+	if err != nil {
+		t.Fatalf("Failed to count zip filesystem: %v", err)
+	}
+	if zipReport.Total != report.Total {
+		t.Errorf("Expected zip counts %+v, got %+v", report.Total, zipReport.Total)
+	}
+
+	if _, err := CountFS(context.Background(), setupTestFS(), Options{Config: testConfig, GitTracked: true}); err == nil {
+		t.Error("Expected an error for git tracked mode")
+	}
+}
+
+func TestCountCancelled(t *testing.T) {
+	testDir := setupTestDirectory(t, testFiles)
+
+	// count one file before cancelling, the walk stops at the next one
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := Options{Config: testConfig}.newScanner(ctx, testDir)
+	if err != nil {
+		t.Fatalf("Failed to create scanner: %v", err)
+	}
+	if err := s.useDir(testDir); err != nil {
+		t.Fatalf("Failed to use directory: %v", err)
+	}
+	counted := 0
+	err = s.walk(ctx, func(name string) error {
+		counted++
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the walk to be cancelled, got %v", err)
+	}
+	if counted != 1 {
+		t.Errorf("Expected the walk to stop after 1 file, visited %d", counted)
+	}
+
+	// a cancelled count still returns the (empty) partial report
+	report, err := Count(ctx, testDir, Options{Config: testConfig})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if report == nil {
+		t.Fatal("Expected a partial report")
+	}
+	if report.Total.Code != 0 {
+		t.Errorf("Expected no lines counted, got %d", report.Total.Code)
+	}
+
+	// a cancelled clone leaves no temporary directory behind
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+	if _, err := Clone(ctx, testDir, CloneOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the clone to be cancelled, got %v", err)
+	}
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to read temporary directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected the clone directory to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var events []Progress
+	report, err := CountFS(context.Background(), setupTestFS(), Options{
+		Config:          testConfig,
+		ExcludePatterns: []string{`^node_modules$`},
+		Progress: func(progress Progress) {
+			events = append(events, progress)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to count filesystem: %v", err)
+	}
+	if len(events) == 0 {
+		t.Fatal("Expected progress events")
+	}
+
+	for i := 1; i < len(events); i++ {
+		if events[i].FilesVisited != events[i-1].FilesVisited+1 {
+			t.Errorf("Expected one event per file, got %d after %d", events[i].FilesVisited, events[i-1].FilesVisited)
+		}
+	}
+
+	last := events[len(events)-1]
+	if last.FilesVisited != len(events) {
+		t.Errorf("Expected %d files visited, got %d", len(events), last.FilesVisited)
+	}
+	if lines := report.Total.Code + report.Total.Comment + report.Total.Blank; last.Lines != lines {
+		t.Errorf("Expected %d lines, got %d", lines, last.Lines)
+	}
+	if last.FilesCounted == 0 || last.FilesCounted > last.FilesVisited {
+		t.Errorf("Expected between 1 and %d files counted, got %d", last.FilesVisited, last.FilesCounted)
+	}
+	if last.BytesRead == 0 {
+		t.Error("Expected bytes read")
+	}
+	if last.FilesTotal != 0 {
+		t.Errorf("Expected no known total for a walk, got %d", last.FilesTotal)
+	}
+
+	// a git file list, a tree and a zip archive are known up front, the total is what the scan visits of them
+	files := map[string]string{
+		"src/main.go":                "package main\n",
+		"src/util.go":                "package main\n",
+		"README.md":                  "# readme\n",
+		"vendor/lib/lib.go":          "package lib\n",
+		".cache/tool.go":             "package tool\n",
+		"deep/er/than/the/limit.go":  "package limit\n",
+		"generated/skipped_by_me.go": "package generated\n",
+	}
+	dir := setupTestDirectory(t, files)
+	commitTestDirectory(t, dir)
+	zipPath := filepath.Join(t.TempDir(), "files.zip")
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to create zip file: %v", err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	for name, content := range files {
+		member, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to add zip member: %v", err)
+		}
+		if _, err := member.Write([]byte(content)); err != nil {
+			t.Fatalf("Failed to write zip member: %v", err)
+		}
+	}
+	for _, closer := range []io.Closer{zipWriter, zipFile} {
+		if err := closer.Close(); err != nil {
+			t.Fatalf("Failed to close zip file: %v", err)
+		}
+	}
+
+	for _, count := range []struct {
+		name string
+		root string
+		opts Options
+	}{
+		{"git tracked", dir, Options{GitTracked: true}},
+		{"revision", dir, Options{Rev: "HEAD"}},
+		{"zip", zipPath, Options{}},
+	} {
+		var last Progress
+		count.opts.Config = testConfig
+		count.opts.ExcludePatterns = []string{`^generated$`}
+		count.opts.MaxDepth = 3
+		count.opts.Progress = func(progress Progress) {
+			last = progress
+		}
+		if _, err := Count(context.Background(), count.root, count.opts); err != nil {
+			t.Fatalf("%s: failed to count: %v", count.name, err)
+		}
+		if last.FilesTotal != 3 || last.FilesVisited != last.FilesTotal {
+			t.Errorf("%s: expected 3 files visited out of 3, got %d out of %d", count.name, last.FilesVisited, last.FilesTotal)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	testDir := setupTestDirectory(t, testFiles)
+	cacheDir := t.TempDir()
+
+	// count returns the report of a cached count and the bytes it read
+	count := func(config *Config, hash bool) (*Report, int64) {
+		t.Helper()
+		var bytesRead int64
+		report, err := Count(context.Background(), testDir, Options{
+			Config:          config,
+			ExcludePatterns: []string{`^node_modules$`, `^\.git$`},
+			CacheDir:        cacheDir,
+			CacheHash:       hash,
+			Progress: func(progress Progress) {
+				bytesRead = progress.BytesRead
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to count: %v", err)
+		}
+		return report, bytesRead
+	}
+
+	first, bytesRead := count(testConfig, false)
+	if bytesRead == 0 {
+		t.Fatal("Expected the first count to read files")
+	}
+
+	second, bytesRead := count(testConfig, false)
+	if bytesRead != 0 {
+		t.Errorf("Expected unchanged files to come from the cache, read %d bytes", bytesRead)
+	}
+	if second.Total != first.Total {
+		t.Errorf("Expected cached counts %+v, got %+v", first.Total, second.Total)
+	}
+
+	// a changed file is counted again, with the same size and mtime only hashing notices
+	mainPath := filepath.Join(testDir, "main.go")
+	info, err := os.Stat(mainPath)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	changed := "package main\n\nfunc main() {\n// println(\"hi!\")\n}\n"
+	if len(changed) != len(testFiles["main.go"]) {
+		t.Fatalf("Expected the changed file to keep its size")
+	}
+	if err := os.WriteFile(mainPath, []byte(changed), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Chtimes(mainPath, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("Failed to reset mtime: %v", err)
+	}
+
+	stale, _ := count(testConfig, false)
+	if stale.Total != first.Total {
+		t.Errorf("Expected size and mtime to match the cache, got %+v", stale.Total)
+	}
+
+	hashed, _ := count(testConfig, true)
+	if hashed.Total.Code != first.Total.Code-1 || hashed.Total.Comment != first.Total.Comment+1 {
+		t.Errorf("Expected hashing to notice the changed file, got %+v from %+v", hashed.Total, first.Total)
+	}
+
+	// touching a file does not invalidate a hashed entry
+	now := time.Now()
+	if err := os.Chtimes(mainPath, now, now); err != nil {
+		t.Fatalf("Failed to touch file: %v", err)
+	}
+	touched, _ := count(testConfig, true)
+	if touched.Total != hashed.Total {
+		t.Errorf("Expected touched file to keep its counts %+v, got %+v", hashed.Total, touched.Total)
+	}
+
+	// changing a skip pattern invalidates the cache
+	changedConfig := &Config{Languages: make(map[string]LanguageConfig)}
+	for language, langConfig := range testConfig.Languages {
+		changedConfig.Languages[language] = langConfig
+	}
+	changedConfig.Languages["go"] = LanguageConfig{Extensions: []string{".go"}, SkipPatterns: []string{`^\s*$`}}
+	recounted, bytesRead := count(changedConfig, false)
+	if bytesRead == 0 {
+		t.Error("Expected a changed config to recount files")
+	}
+	if recounted.Languages["go"].Comment != 0 {
+		t.Errorf("Expected no go comments without the comment pattern, got %d", recounted.Languages["go"].Comment)
+	}
+
+	// the caches of directories that are gone are pruned, as are unreadable ones
+	otherDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(otherDir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := Count(context.Background(), otherDir, Options{Config: testConfig, CacheDir: cacheDir}); err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	if err := os.RemoveAll(otherDir); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(cacheDir, "corrupt.json"), []byte("{"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	removed, err := PruneCache(cacheDir, 0)
+	if err != nil {
+		t.Fatalf("Failed to prune cache: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("Expected 2 caches removed, got %d", removed)
+	}
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatalf("Failed to read cache directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected the cache of the test directory to remain, found %d files", len(entries))
+	}
+
+	// old caches are pruned too
+	removed, err = PruneCache(cacheDir, time.Nanosecond)
+	if err != nil {
+		t.Fatalf("Failed to prune cache: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected the old cache to be removed, got %d", removed)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	testDir := setupTestDirectory(t, testFiles)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reports := make(chan Report)
+	done := make(chan error, 1)
+	go func() {
+		done <- Watch(ctx, testDir, Options{
+			Config:          testConfig,
+			ExcludePatterns: []string{`^node_modules$`, `^build$`},
+		}, 10*time.Millisecond, func(report *Report) error {
+			reports <- *report
+			return nil
+		})
+	}()
+
+	// next waits for a count with the given total lines of code, a change may be seen in more than one count
+	timeout := time.After(5 * time.Second)
+	next := func(code int) Report {
+		t.Helper()
+		for {
+			select {
+			case report := <-reports:
+				if code < 0 || report.Total.Code == code {
+					return report
+				}
+			case err := <-done:
+				t.Fatalf("Watch stopped: %v", err)
+			case <-timeout:
+				t.Fatalf("Timed out waiting for %d lines of code", code)
+			}
+		}
+	}
+
+	first := next(-1)
+
+	// a change in an excluded directory is not counted
+	if err := os.WriteFile(filepath.Join(testDir, "build", "more.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	// a new directory with a new file is
+	if err := os.MkdirAll(filepath.Join(testDir, "pkg"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(testDir, "pkg", "pkg.go"), []byte("package pkg\n\nvar X = 1\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	second := next(first.Total.Code + 2)
+	if second.Languages["go"].Blank != first.Languages["go"].Blank+1 {
+		t.Errorf("Expected one more blank line, got %+v", second.Languages["go"])
+	}
+
+	// files in the new directory are watched as well
+	if err := os.Remove(filepath.Join(testDir, "pkg", "pkg.go")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	third := next(first.Total.Code)
+	if third.Total != first.Total {
+		t.Errorf("Expected %+v after removing the file, got %+v", first.Total, third.Total)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected Watch to stop with the context, got %v", err)
+	}
+
+	if err := Watch(context.Background(), filepath.Join(testDir, "main.go"), Options{Config: testConfig}, time.Second, nil); err == nil {
+		t.Error("Expected an error watching a file")
+	}
+}
+
+func TestWatchRemovedWhileCounting(t *testing.T) {
+	testDir := setupTestDirectory(t, testFiles)
+
+	// main.go is removed after README.md is counted, once the walk has listed it
+	removed := false
+	opts := Options{
+		Config: testConfig,
+		Progress: func(Progress) {
+			if !removed {
+				removed = true
+				_ = os.Remove(filepath.Join(testDir, "main.go"))
+			}
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var report *Report
+	err := Watch(ctx, testDir, opts, 10*time.Millisecond, func(r *Report) error {
+		report = r
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("Expected the count to start over, got %v", err)
+	}
+
+	expected, err := Count(context.Background(), testDir, Options{Config: testConfig})
+	if err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	if report.Total != expected.Total {
+		t.Errorf("Expected %+v without main.go, got %+v", expected.Total, report.Total)
+	}
+}
+
+// errStop stops a watch from its callback
+var errStop = errors.New("stop")
+
+func TestPollWatcher(t *testing.T) {
+	testDir := setupTestDirectory(t, testFiles)
+
+	s, err := Options{Config: testConfig, ExcludePatterns: []string{`^build$`}}.newScanner(context.Background(), testDir)
+	if err != nil {
+		t.Fatalf("Failed to create scanner: %v", err)
+	}
+	if err := s.useDir(testDir); err != nil {
+		t.Fatalf("Failed to use directory: %v", err)
+	}
+
+	w := &pollWatcher{interval: 5 * time.Millisecond}
+	if err := w.watch(context.Background(), s); err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+
+	// changes to excluded or uncounted files go unnoticed
+	if err := os.WriteFile(filepath.Join(testDir, "build", "more.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(testDir, "notes.txt"), []byte("notes\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := w.wait(ctx, s); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected no change to be noticed, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(testDir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.wait(ctx, s); err != nil {
+		t.Errorf("Expected the change to be noticed, got %v", err)
+	}
+}
+
+func TestRollup(t *testing.T) {
+	report, err := CountFS(context.Background(), setupTestFS(), Options{
+		Config:          testConfig,
+		ExcludePatterns: []string{`^node_modules$`, `^\.git$`},
+		Files:           true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to count filesystem: %v", err)
+	}
+	if len(report.Files) != 9 {
+		t.Fatalf("Expected 9 files, got %d", len(report.Files))
+	}
+
+	// summary flattens a tree to "path files code comment blank" lines, depth first
+	var summary func(d *Dir) []string
+	summary = func(d *Dir) []string {
+		lines := []string{fmt.Sprintf("%s %d %d %d %d", d.Path, d.Files, d.Code, d.Comment, d.Blank)}
+		for _, sub := range d.Dirs {
+			lines = append(lines, summary(sub)...)
+		}
+		return lines
+	}
+
+	tests := []struct {
+		name     string
+		depth    int
+		expected []string
+	}{
+		{
+			name:  "every level",
+			depth: 0,
+			expected: []string{
+				". 9 27 6 8",
+				"build 1 2 1 1",
+				"gen 1 2 1 1",
+				"src 3 11 2 4",
+				"src/tests 1 3 1 1",
+			},
+		},
+		{
+			name:  "top level only",
+			depth: 1,
+			expected: []string{
+				". 9 27 6 8",
+				"build 1 2 1 1",
+				"gen 1 2 1 1",
+				"src 3 11 2 4",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := summary(Rollup(report.Files, tt.depth))
+			if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+				t.Errorf("Expected tree:\n%s\ngot:\n%s", strings.Join(tt.expected, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+
+	// the largest directory first
+	tree := Rollup(report.Files, 0)
+	tree.Sort(func(a, b *Dir) int {
+		return b.Code - a.Code
+	})
+	if tree.Dirs[0].Path != "src" {
+		t.Errorf("Expected src to sort first, got %s", tree.Dirs[0].Path)
+	}
+}
+
+func TestTopAndOutliers(t *testing.T) {
+	files := []FileCounts{
+		{Path: "small.go", Language: "go", Counts: Counts{Code: 10, Comment: 5}},
+		{Path: "big.go", Language: "go", Counts: Counts{Code: 1500, Comment: 300, Blank: 200}},
+		{Path: "bare.go", Language: "go", Counts: Counts{Code: 400, Comment: 2, Blank: 50}},
+		{Path: "api/service.pb.go", Language: "go", Counts: Counts{Generated: 540}},
+		{Path: "tiny.go", Language: "go", Counts: Counts{Code: 10}},
+	}
+	languages := map[string]Counts{"go": {Code: 1920, Comment: 407, Blank: 250, Generated: 540}}
+
+	top := Top(files, 3)
+	var paths []string
+	for _, file := range top {
+		paths = append(paths, file.Path)
+	}
+	if strings.Join(paths, " ") != "big.go bare.go small.go" {
+		t.Errorf("Expected the largest files first, got %v", paths)
+	}
+	if len(Top(files, 10)) != len(files) {
+		t.Errorf("Expected every file when asking for more than there are")
+	}
+	if files[0].Path != "small.go" {
+		t.Error("Expected Top to leave the files in their order")
+	}
+
+	outliers := Outliers(files, languages, DefaultOutlierOptions)
+	expected := map[string]int{ // path to number of reasons
+		"big.go":            1, // over the limit
+		"bare.go":           1, // 0.5% comments against 17.5% for go
+		"api/service.pb.go": 1, // generated
+	}
+	if len(outliers) != len(expected) {
+		t.Errorf("Expected %d outliers, got %+v", len(expected), outliers)
+	}
+	for _, outlier := range outliers {
+		if reasons, ok := expected[outlier.Path]; !ok || len(outlier.Reasons) != reasons {
+			t.Errorf("Unexpected outlier %s: %v", outlier.Path, outlier.Reasons)
+		}
+	}
+
+	// tiny.go has no comments at all but is too small to judge
+	if outliers := Outliers(files, languages, OutlierOptions{CommentRatio: 0.25, MinLines: 100}); len(outliers) != 2 {
+		t.Errorf("Expected 2 outliers without the line limit, got %+v", outliers)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	baseline := &Report{
+		Total:     Counts{Code: 100},
+		Languages: map[string]Counts{"go": {Code: 80}, "python": {Code: 20}},
+		Files: []FileCounts{
+			{Path: "main.go", Language: "go", Counts: Counts{Code: 30}},
+			{Path: "legacy/old.go", Language: "go", Counts: Counts{Code: 50}},
+			{Path: "tools/gen.py", Language: "python", Counts: Counts{Code: 20}},
+		},
+	}
+	report := &Report{
+		Total:     Counts{Code: 130},
+		Languages: map[string]Counts{"go": {Code: 110}, "python": {Code: 20}},
+		Files: []FileCounts{
+			{Path: "main.go", Language: "go", Counts: Counts{Code: 30}},
+			{Path: "legacy/old.go", Language: "go", Counts: Counts{Code: 70}},
+			{Path: "legacy/new.go", Language: "go", Counts: Counts{Code: 10}},
+			{Path: "tools/gen.py", Language: "python", Counts: Counts{Code: 20}},
+		},
+	}
+	growth := func(percent float64) *float64 {
+		return &percent
+	}
+
+	tests := []struct {
+		name     string
+		policy   Policy
+		expected []string // "path: message" of every violation
+	}{
+		{
+			name:     "within budget",
+			policy:   Policy{MaxFileLines: 100, Total: Budget{MaxLines: 200, MaxGrowth: growth(50)}},
+			expected: nil,
+		},
+		{
+			name:     "file too large",
+			policy:   Policy{MaxFileLines: 50},
+			expected: []string{"legacy/old.go: 70 lines of code, over the limit of 50 per file"},
+		},
+		{
+			name: "language and total",
+			policy: Policy{
+				Total:     Budget{MaxLines: 120},
+				Languages: map[string]Budget{"go": {MaxGrowth: growth(25)}, "python": {MaxGrowth: growth(0)}},
+			},
+			expected: []string{
+				"go: grew 37.5% from 80 to 110 lines of code, over the limit of 25%",
+				"total: 130 lines of code, over the limit of 120",
+			},
+		},
+		{
+			name:   "directory",
+			policy: Policy{Dirs: map[string]Budget{"legacy/": {MaxLines: 100, MaxGrowth: growth(10)}, "tools": {MaxLines: 20}}},
+			expected: []string{
+				"legacy: grew 60.0% from 50 to 80 lines of code, over the limit of 10%",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations, err := tt.policy.Check(report, baseline)
+			if err != nil {
+				t.Fatalf("Failed to check policy: %v", err)
+			}
+			var got []string
+			for _, violation := range violations {
+				got = append(got, violation.Path+": "+violation.Message)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+				t.Errorf("Expected violations:\n%s\ngot:\n%s", strings.Join(tt.expected, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+
+	// growth needs a baseline, of files for directories
+	policy := Policy{Dirs: map[string]Budget{"legacy": {MaxGrowth: growth(10)}}}
+	if _, err := policy.Check(report, nil); err == nil {
+		t.Error("Expected an error without a baseline")
+	}
+	if _, err := policy.Check(report, &Report{Total: baseline.Total}); err == nil {
+		t.Error("Expected an error for a baseline without files")
+	}
+
+	// the baseline is found next to the policy, and misspelt limits are rejected
+	dir := t.TempDir()
+	policyPath := filepath.Join(dir, PolicyFile)
+	if err := os.WriteFile(policyPath, []byte(`{"max_file_lines": 500, "baseline": "base.json"}`), 0644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	loaded, err := LoadPolicy(policyPath)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	if loaded.MaxFileLines != 500 || loaded.Baseline != filepath.Join(dir, "base.json") {
+		t.Errorf("Unexpected policy %+v", loaded)
+	}
+	if err := os.WriteFile(policyPath, []byte(`{"max_lines_per_file": 500}`), 0644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	if _, err := LoadPolicy(policyPath); err == nil {
+		t.Error("Expected an error for an unknown field")
+	}
+}
+
+func TestCompareAndRatchet(t *testing.T) {
+	before := &Report{
+		Total:     Counts{Code: 80, Comment: 20, Blank: 10},
+		Languages: map[string]Counts{"go": {Code: 70, Comment: 20, Blank: 10}, "python": {Code: 10}},
+		Files: []FileCounts{
+			{Path: "main.go", Language: "go", Counts: Counts{Code: 20, Comment: 10, Blank: 5}},
+			{Path: "legacy/old.go", Language: "go", Counts: Counts{Code: 50, Comment: 10, Blank: 5}},
+			{Path: "tools/gen.py", Language: "python", Counts: Counts{Code: 10}},
+		},
+	}
+	after := &Report{
+		Total:     Counts{Code: 100, Comment: 20, Blank: 12},
+		Languages: map[string]Counts{"go": {Code: 100, Comment: 20, Blank: 12}},
+		Files: []FileCounts{
+			{Path: "main.go", Language: "go", Counts: Counts{Code: 20, Comment: 10, Blank: 5}},
+			{Path: "legacy/old.go", Language: "go", Counts: Counts{Code: 55, Comment: 10, Blank: 5}},
+			{Path: "legacy/sub/new.go", Language: "go", Counts: Counts{Code: 25, Blank: 2}},
+		},
+	}
+
+	comparison := Compare(before, after, 1)
+	if comparison.Total != (Change{Before: before.Total, After: after.Total}) {
+		t.Errorf("Unexpected total change %+v", comparison.Total)
+	}
+	if change := comparison.Languages["python"]; change.Before.Code != 10 || change.After.Code != 0 {
+		t.Errorf("Expected python to be removed, got %+v", change)
+	}
+
+	var dirs []string
+	for _, dir := range comparison.Dirs {
+		dirs = append(dirs, fmt.Sprintf("%s %d->%d", dir.Path, dir.Before.Code, dir.After.Code))
+	}
+	expected := ". 80->100, legacy 50->80, tools 10->0"
+	if strings.Join(dirs, ", ") != expected {
+		t.Errorf("Expected directories %s, got %s", expected, strings.Join(dirs, ", "))
+	}
+
+	violations := Ratchet(before, after, []string{"legacy/", "tools"})
+	var got []string
+	for _, violation := range violations {
+		got = append(got, violation.Path+": "+violation.Message)
+	}
+	expectedViolations := []string{
+		"total: comment ratio dropped from 20.0% to 16.7%",
+		"legacy: legacy code grew from 50 to 80 lines",
+	}
+	if strings.Join(got, "\n") != strings.Join(expectedViolations, "\n") {
+		t.Errorf("Expected violations:\n%s\ngot:\n%s", strings.Join(expectedViolations, "\n"), strings.Join(got, "\n"))
+	}
+
+	if violations := Ratchet(after, after, []string{"legacy"}); len(violations) != 0 {
+		t.Errorf("Expected no violations without a change, got %+v", violations)
+	}
+}
+
+func TestGeneratedFiles(t *testing.T) {
+	files := map[string]string{
+		"main.go":                       "package main\n\nfunc main() {}\n",
+		"detect.go":                     "package main\n\nvar marker = \"// Code generated by hand. DO NOT EDIT.\"\n",
+		"mock.go":                       "// Code generated by MockGen. DO NOT EDIT.\n\npackage main\n\ntype Mock struct{}\n",
+		"api/service.pb.go":             "package api\n\ntype Request struct{}\n",
+		"api/zz_generated.deepcopy.go":  "package api\n\nfunc (in *Request) DeepCopy() {}\n",
+		"api/fake_client.go":            "package api\n\ntype FakeClient struct{}\n",
+		"web/package-lock.json":         "{\n  \"lockfileVersion\": 3\n}\n",
+		"web/schema.js":                 "/* @generated by relay */\nmodule.exports = {};\n",
+		"web/app.js":                    "// loads the generated schema\nmodule.exports = require(\"./schema\");\n",
+		"web/dist/lib.min.js":           "var a=1;\n",
+		"web/node/generated_helpers.go": "package node\n",
+	}
+	config := &Config{
+		Languages: map[string]LanguageConfig{
+			"go": {
+				Extensions:     []string{".go"},
+				SkipPatterns:   []string{`^\s*//`, `^\s*$`},
+				GeneratedFiles: []string{`^fake_.*\.go$`}, // counterfeiter output
+			},
+			"javascript": {Extensions: []string{".js"}, SkipPatterns: []string{`^\s*//`, `^\s*/\*`, `^\s*$`}},
+			"json":       {Extensions: []string{".json"}},
+		},
+	}
+	fsys := make(fstest.MapFS)
+	for name, content := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+
+	report, err := CountFS(context.Background(), fsys, Options{Config: config, Files: true})
+	if err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+
+	generated := make(map[string]bool)
+	for _, file := range report.Files {
+		if file.Generated > 0 {
+			if file.Code+file.Comment+file.Blank != 0 {
+				t.Errorf("Expected every line of %s in the generated column, got %+v", file.Path, file.Counts)
+			}
+			generated[file.Path] = true
+		}
+	}
+	expected := []string{
+		"api/fake_client.go",
+		"api/service.pb.go",
+		"api/zz_generated.deepcopy.go",
+		"mock.go",
+		"web/package-lock.json",
+		"web/schema.js",
+		"web/dist/lib.min.js",
+	}
+	for _, name := range expected {
+		if !generated[name] {
+			t.Errorf("Expected %s to be generated", name)
+		}
+	}
+	if len(generated) != len(expected) {
+		t.Errorf("Expected %d generated files, got %v", len(expected), generated)
+	}
+
+	if got := report.Languages["go"]; got.Code != 5 || got.Generated != 14 {
+		t.Errorf("Expected 5 lines of go and 14 generated, got %+v", got)
+	}
+
+	// counted like any other file when asked to
+	counted, err := CountFS(context.Background(), fsys, Options{Config: config, CountGenerated: true})
+	if err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	if counted.Total.Generated != 0 || counted.Total.Code+counted.Total.Comment+counted.Total.Blank != report.Total.Code+report.Total.Comment+report.Total.Blank+report.Total.Generated {
+		t.Errorf("Expected every line to be counted, got %+v from %+v", counted.Total, report.Total)
+	}
+
+	// files on disk, cached files and blobs are detected the same way
+	checkCountModes(t, setupTestDirectory(t, files), Options{Config: config}, func(name string, got *Report) {
+		t.Helper()
+		if got.Total != report.Total {
+			t.Errorf("%s: expected %+v, got %+v", name, report.Total, got.Total)
+		}
+	})
+}
+
+func TestVendored(t *testing.T) {
+	files := map[string]string{
+		"main.go":                            "package main\n\nfunc main() {}\n",
+		"vendor/github.com/pkg/errors.go":    "package errors\n",
+		"vendor/modules.txt":                 "# github.com/pkg/errors\n",
+		"web/app.js":                         "module.exports = {};\n",
+		"web/node_modules/left-pad/index.js": "module.exports = pad;\n",
+		"web/node_modules/left-pad/lib.js":   "function pad() {}\n",
+		"lib/extern/zlib.go":                 "package zlib\n",
+		"vendored.go":                        "package main\n", // only directories named like vendored code are skipped
+	}
+	config := &Config{
+		Languages: map[string]LanguageConfig{
+			"go":         {Extensions: []string{".go"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+			"javascript": {Extensions: []string{".js"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+		},
+		Vendored: []string{`(^|/)extern$`}, // added to the built-in list
+	}
+	fsys := make(fstest.MapFS)
+	for name, content := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+
+	report, err := CountFS(context.Background(), fsys, Options{Config: config})
+	if err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	if report.Total.Code != 4 {
+		t.Errorf("Expected 4 lines of code outside vendored code, got %+v", report.Total)
+	}
+	expected := []string{"lib/extern", "vendor", "web/node_modules"}
+	if !reflect.DeepEqual(report.Vendored, expected) {
+		t.Errorf("Expected %+v to be skipped, got %+v", expected, report.Vendored)
+	}
+
+	// counted like any other code when asked to
+	included, err := CountFS(context.Background(), fsys, Options{Config: config, IncludeVendored: true})
+	if err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	if included.Total.Code != 8 || included.Vendored != nil {
+		t.Errorf("Expected 8 lines of code and nothing skipped, got %+v and %+v", included.Total, included.Vendored)
+	}
+
+	// a directory on disk and a revision skip the same files
+	dir := setupTestDirectory(t, files)
+	checkCountModes(t, dir, Options{Config: config}, func(name string, got *Report) {
+		t.Helper()
+		if got.Total != report.Total || !reflect.DeepEqual(got.Vendored, expected) {
+			t.Errorf("%s: expected %+v and %+v, got %+v and %+v", name, report.Total, expected, got.Total, got.Vendored)
+		}
+	})
+
+	// and so do the history and the diff of two revisions
+	samples, err := History(context.Background(), dir, HistoryOptions{Options: Options{Config: config}, Every: "commit"})
+	if err != nil {
+		t.Fatalf("Failed to count history: %v", err)
+	}
+	if len(samples) != 1 || samples[0].TotalLines != report.Total.Code {
+		t.Errorf("Expected %d lines of code in the history, got %+v", report.Total.Code, samples)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "vendor", "github.com", "pkg", "wrap.go"), []byte("package errors\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "commit", "--quiet", "-m", "vendor more")
+	diff, err := DiffRevisions(context.Background(), dir, "HEAD~1", "HEAD", Options{Config: config})
+	if err != nil {
+		t.Fatalf("Failed to diff revisions: %v", err)
+	}
+	if len(diff.Files) != 0 {
+		t.Errorf("Expected vendored changes to be skipped, got %+v", diff.Files)
+	}
+
+	// an invalid pattern is caught when the config is loaded
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"languages": {}, "vendored": ["("]}`), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for an invalid vendored pattern")
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	tests := []struct {
+		name     string
+		block    []byte
+		expected bool
+	}{
+		{"empty", nil, false},
+		{"ascii", []byte("SELECT 1;\n"), false},
+		{"utf-8", []byte("-- größe\nSELECT 'naïve';\n"), false},
+		{"latin-1 accents", []byte("-- gr\xf6\xdfe\nSELECT 'na\xefve';\n"), false},
+		{"nul byte", []byte("MATLAB 5.0 MAT-file\x00\x01"), true},
+		{"invalid utf-8", []byte("\x89\xfe\xa0\xc3\xff\x9c\xd2\x81\x90\xfa"), true},
+		{"rune cut off at the end", append(bytes.Repeat([]byte("a"), 10), 0xe2, 0x82), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isBinary(tt.block); got != tt.expected {
+				t.Errorf("Expected isBinary to be %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBinaryFiles(t *testing.T) {
+	files := map[string]string{
+		"query.sql":   "SELECT 1;\n\n-- done\n",
+		"dump.sql":    "\x00\x01\x02SQLite format\n\x00",
+		"data/mat.m":  "\x89\xfe\xa0\xc3\xff\x9c\xd2\x81\n\x90\xfa",
+		"analysis.m":  "x = 1;\n% plot\nplot(x);\n",
+		"legacy.sql":  "-- gr\xf6\xdfe\nSELECT 1;\n", // Latin-1 text is still text
+		"scratch.sql": "",
+	}
+	config := &Config{
+		Languages: map[string]LanguageConfig{
+			"sql":    {Extensions: []string{".sql"}, SkipPatterns: []string{`^\s*--`, `^\s*$`}},
+			"matlab": {Extensions: []string{".m"}, SkipPatterns: []string{`^\s*%`, `^\s*$`}},
+		},
+	}
+	expected := []string{"data/mat.m", "dump.sql"}
+	check := func(name string, report *Report) {
+		t.Helper()
+		if report.Total.Code != 4 || report.Total.Comment != 3 || report.Total.Blank != 1 {
+			t.Errorf("%s: expected 4 lines of code, 3 comments and 1 blank line, got %+v", name, report.Total)
+		}
+		binary := slices.Sorted(slices.Values(report.Binary))
+		if !slices.Equal(binary, expected) {
+			t.Errorf("%s: expected %v to be skipped as binary, got %v", name, expected, binary)
+		}
+	}
+
+	// binary files are not cached, they are sniffed again on every run, and blobs are sniffed the same way
+	dir := setupTestDirectory(t, files)
+	checkCountModes(t, dir, Options{Config: config}, check)
+
+	// a diff skips them as well, listing them instead
+	diff, err := DiffDirs(context.Background(), t.TempDir(), dir, Options{Config: config})
+	if err != nil {
+		t.Fatalf("Failed to diff: %v", err)
+	}
+	if len(diff.Files) != 3 || diff.Total.Code.Added != 4 {
+		t.Errorf("Expected 3 added text files with 4 lines of code, got %+v", diff.Files)
+	}
+	if !slices.Equal(diff.Binary, expected) {
+		t.Errorf("Expected %v to be skipped as binary, got %v", expected, diff.Binary)
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	dir := filepath.Join("..", "test_dir", "encodings")
+	expected, err := os.ReadFile(filepath.Join(dir, "utf8.sql"))
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+
+	tests := []struct {
+		file     string
+		encoding string // configured, detected when empty
+	}{
+		{"utf8.sql", ""},
+		{"utf8_bom.sql", ""},
+		{"utf16le_bom.sql", ""},
+		{"utf16be_bom.sql", ""},
+		{"utf16le.sql", ""},
+		{"utf16be.sql", ""},
+		{"utf32le_bom.sql", ""},
+		{"utf32be_bom.sql", ""},
+		{"latin1.sql", ""},
+		{"latin1.sql", "latin-1"},
+		{"utf16le_bom.sql", "utf-16le"},
+		{"utf16be.sql", "utf-16be"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file+" "+tt.encoding, func(t *testing.T) {
+			file, err := os.Open(filepath.Join(dir, tt.file))
+			if err != nil {
+				t.Fatalf("Failed to open fixture: %v", err)
+			}
+			defer func(file *os.File) {
+				_ = file.Close()
+			}(file)
+
+			body, _, binary := decode(file, tt.encoding)
+			if binary {
+				t.Fatal("Expected text, got a binary file")
+			}
+			text, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+			if !bytes.Equal(text, expected) {
+				t.Errorf("Expected %q, got %q", expected, text)
+			}
+		})
+	}
+
+	// every file is counted the same, whatever its encoding
+	config := &Config{
+		Languages: map[string]LanguageConfig{
+			"sql":    {Extensions: []string{".sql"}, SkipPatterns: []string{`^\s*--`, `^\s*$`}},
+			"delphi": {Extensions: []string{".pas"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+		},
+	}
+	report, err := Count(context.Background(), dir, Options{Config: config, Files: true})
+	if err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	for _, file := range report.Files {
+		want := Counts{Code: 3, Comment: 2, Blank: 1}
+		if file.Language == "delphi" {
+			want = Counts{Code: 4, Comment: 1}
+		}
+		if file.Counts != want {
+			t.Errorf("Expected %+v for %s, got %+v", want, file.Path, file.Counts)
+		}
+	}
+	if len(report.Files) != 10 || len(report.Binary) != 0 {
+		t.Errorf("Expected 10 text files, got %d and %v", len(report.Files), report.Binary)
+	}
+
+	// re-encoding a file changes none of its lines
+	utf16, err := os.ReadFile(filepath.Join(dir, "utf16le.sql"))
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	oldDir := setupTestDirectory(t, map[string]string{"query.sql": string(expected)})
+	newDir := setupTestDirectory(t, map[string]string{"query.sql": string(utf16)})
+	diff, err := DiffDirs(context.Background(), oldDir, newDir, Options{Config: config})
+	if err != nil {
+		t.Fatalf("Failed to diff: %v", err)
+	}
+	if len(diff.Files) != 0 || len(diff.Binary) != 0 {
+		t.Errorf("Expected no change between UTF-8 and UTF-16, got %+v and %v", diff.Files, diff.Binary)
+	}
+
+	// UTF-16 that is not text is still binary once decoded
+	if _, _, binary := decode(bytes.NewReader([]byte{0xff, 0xfe, 'a', 0, 0, 0, 'b', 0}), ""); !binary {
+		t.Error("Expected UTF-16 with NULs to be binary")
+	}
+
+	// an unknown encoding is caught when the config is loaded
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"languages": {"sql": {"extensions": [".sql"], "encoding": "ebcdic"}}}`), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for an unknown encoding")
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	skipRegexps, err := compileSkipPatterns([]string{`^\s*//`, `^\s*$`})
+	if err != nil {
+		t.Fatalf("Failed to compile skip patterns: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		expected Counts
+		endings  string
+	}{
+		{"none", "", Counts{}, ""},
+		{"no line ending", "x := 1", Counts{Code: 1}, ""},
+		{"lf", "x := 1\n\n// done\n", Counts{Code: 1, Comment: 1, Blank: 1}, LineEndingsLF},
+		{"crlf", "x := 1\r\n\r\n// done\r\n", Counts{Code: 1, Comment: 1, Blank: 1}, LineEndingsCRLF},
+		{"cr", "x := 1\r\r// done\r", Counts{Code: 1, Comment: 1, Blank: 1}, LineEndingsCR},
+		{"cr without a last line ending", "x := 1\r  \ry := 2", Counts{Code: 2, Blank: 1}, LineEndingsCR},
+		{"mixed", "x := 1\r\ny := 2\nz := 3\r", Counts{Code: 3}, LineEndingsMixed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts, endings, err := countReader(strings.NewReader(tt.content), skipRegexps)
+			if err != nil {
+				t.Fatalf("Failed to count: %v", err)
+			}
+			if counts != tt.expected || endings != tt.endings {
+				t.Errorf("Expected %+v and %q, got %+v and %q", tt.expected, tt.endings, counts, endings)
+			}
+
+			// a \r\n split between two reads is still one line ending
+			counts, endings, err = countReader(iotest.OneByteReader(strings.NewReader(tt.content)), skipRegexps)
+			if err != nil {
+				t.Fatalf("Failed to count: %v", err)
+			}
+			if counts != tt.expected || endings != tt.endings {
+				t.Errorf("Reading byte by byte, expected %+v and %q, got %+v and %q", tt.expected, tt.endings, counts, endings)
+			}
+		})
+	}
+
+	// the style is reported per file, mixed files are listed
+	config := &Config{
+		Languages: map[string]LanguageConfig{
+			"go": {Extensions: []string{".go"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+		},
+	}
+	fsys := fstest.MapFS{
+		"unix.go":    {Data: []byte("package main\n")},
+		"windows.go": {Data: []byte("package main\r\n\r\n")},
+		"mixed.go":   {Data: []byte("package main\r\n\nfunc main() {}\n")},
+	}
+	report, err := CountFS(context.Background(), fsys, Options{Config: config, Files: true})
+	if err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	endings := make(map[string]string)
+	for _, file := range report.Files {
+		endings[file.Path] = file.LineEndings
+	}
+	expected := map[string]string{"unix.go": LineEndingsLF, "windows.go": LineEndingsCRLF, "mixed.go": LineEndingsMixed}
+	if !maps.Equal(endings, expected) {
+		t.Errorf("Expected line endings %v, got %v", expected, endings)
+	}
+	if !slices.Equal(report.MixedLineEndings, []string{"mixed.go"}) {
+		t.Errorf("Expected mixed.go to have mixed line endings, got %v", report.MixedLineEndings)
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	if !canFollowSymlinks {
+		t.Skip("symlinks cannot be followed on this platform")
+	}
+
+	base := setupTestDirectory(t, map[string]string{
+		"repo/src/main.go":      "package main\n\nfunc main() {}\n",
+		"shared/lib/util.go":    "package lib\n\n// Util does nothing\nfunc Util() {}\n",
+		"shared/lib/unused.txt": "not counted\n",
+	})
+	root := filepath.Join(base, "repo")
+	links := map[string]string{
+		"repo/lib":          "../shared/lib", // shared code outside the directory
+		"repo/src/loop":     "..",            // a cycle
+		"repo/again":        "src",           // the same directory twice
+		"repo/alias.go":     "src/main.go",   // the same file twice
+		"repo/dangling.go":  "missing.go",
+		"repo/src/gone/dir": "../../nowhere",
+	}
+	for name, target := range links {
+		path := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Skipf("Failed to create symlink: %v", err)
+		}
+	}
+	config := &Config{
+		Languages: map[string]LanguageConfig{
+			"go": {Extensions: []string{".go"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		follow      bool
+		expected    Counts
+		brokenLinks []string
+	}{
+		// main.go and alias.go
+		{"linked files only", false, Counts{Code: 4, Blank: 2}, []string{"dangling.go", "src/gone/dir"}},
+		// main.go and util.go once each, src is walked as again which comes first
+		{"following symlinks", true, Counts{Code: 4, Comment: 1, Blank: 2}, []string{"again/gone/dir", "dangling.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := Count(context.Background(), root, Options{Config: config, FollowSymlinks: tt.follow})
+			if err != nil {
+				t.Fatalf("Failed to count: %v", err)
+			}
+			if report.Total != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, report.Total)
+			}
+			broken := slices.Sorted(slices.Values(report.BrokenLinks))
+			if !slices.Equal(broken, tt.brokenLinks) {
+				t.Errorf("Expected broken links %v, got %v", tt.brokenLinks, broken)
+			}
+		})
+	}
+}
+
+func TestWalkLimits(t *testing.T) {
+	files := map[string]string{
+		"main.go":                    "package main\n",
+		"big.go":                     "package main\n\n" + strings.Repeat("var x = 1\n", 100),
+		"pkg/a.go":                   "package pkg\n",
+		"pkg/deep/b.go":              "package deep\n",
+		".github/workflows/check.go": "package workflows\n",
+		".cache/tool/gen.go":         "package tool\n",
+		".tools/lint.go":             "package tools\n",
+		".env.go":                    "package main\n", // hidden files are counted, only directories are hidden
+	}
+	dir := setupTestDirectory(t, files)
+	config := &Config{
+		Languages: map[string]LanguageConfig{
+			"go": {Extensions: []string{".go"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+		},
+		HiddenDirs: []string{".tools"},
+	}
+
+	tests := []struct {
+		name     string
+		opts     Options
+		expected []string
+		tooLarge []string
+	}{
+		{
+			name:     "hidden directories skipped",
+			expected: []string{".env.go", ".github/workflows/check.go", ".tools/lint.go", "big.go", "main.go", "pkg/a.go", "pkg/deep/b.go"},
+		},
+		{
+			name:     "hidden directories walked",
+			opts:     Options{Hidden: true},
+			expected: []string{".cache/tool/gen.go", ".env.go", ".github/workflows/check.go", ".tools/lint.go", "big.go", "main.go", "pkg/a.go", "pkg/deep/b.go"},
+		},
+		{
+			name:     "one level",
+			opts:     Options{MaxDepth: 1},
+			expected: []string{".env.go", "big.go", "main.go"},
+		},
+		{
+			name:     "two levels",
+			opts:     Options{MaxDepth: 2},
+			expected: []string{".env.go", ".tools/lint.go", "big.go", "main.go", "pkg/a.go"},
+		},
+		{
+			name:     "size limit",
+			opts:     Options{MaxFileSize: 100},
+			expected: []string{".env.go", ".github/workflows/check.go", ".tools/lint.go", "main.go", "pkg/a.go", "pkg/deep/b.go"},
+			tooLarge: []string{"big.go"},
+		},
+		{
+			name:     "one filesystem",
+			opts:     Options{OneFileSystem: true},
+			expected: []string{".env.go", ".github/workflows/check.go", ".tools/lint.go", "big.go", "main.go", "pkg/a.go", "pkg/deep/b.go"},
+		},
+	}
+
+	// a revision and a tar archive of the directory are limited the same way
+	commitTestDirectory(t, dir)
+	tarPath := filepath.Join(t.TempDir(), "files.tar")
+	tarFile, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatalf("Failed to create tar file: %v", err)
+	}
+	tarWriter := tar.NewWriter(tarFile)
+	for name, content := range files {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if _, err := tarWriter.Write([]byte(content)); err != nil {
+			t.Fatalf("Failed to write tar member: %v", err)
+		}
+	}
+	for _, closer := range []io.Closer{tarWriter, tarFile} {
+		if err := closer.Close(); err != nil {
+			t.Fatalf("Failed to close tar file: %v", err)
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.opts.OneFileSystem && !canFollowSymlinks {
+				t.Skip("devices are not known on this platform")
+			}
+			tt.opts.Config = config
+			tt.opts.Files = true
+			revision := tt.opts
+			revision.Rev = "HEAD"
+
+			for _, count := range []struct {
+				name string
+				root string
+				opts Options
+			}{{"directory", dir, tt.opts}, {"revision", dir, revision}, {"archive", tarPath, tt.opts}} {
+				report, err := Count(context.Background(), count.root, count.opts)
+				if err != nil {
+					t.Fatalf("%s: failed to count: %v", count.name, err)
+				}
+				var counted []string
+				for _, file := range report.Files {
+					counted = append(counted, file.Path)
+				}
+				slices.Sort(counted)
+				if !slices.Equal(counted, tt.expected) {
+					t.Errorf("%s: expected %v to be counted, got %v", count.name, tt.expected, counted)
+				}
+				if !slices.Equal(report.TooLarge, tt.tooLarge) {
+					t.Errorf("%s: expected %v to be too large, got %v", count.name, tt.tooLarge, report.TooLarge)
+				}
+
+				// the history walks the same directories as a count
+				if count.name == "directory" {
+					samples, err := History(context.Background(), dir, HistoryOptions{Options: tt.opts, Every: "commit"})
+					if err != nil {
+						t.Fatalf("Failed to count history: %v", err)
+					}
+					if len(samples) != 1 || samples[0].TotalLines != report.Total.Code {
+						t.Errorf("Expected %d lines of code in the history, got %+v", report.Total.Code, samples)
+					}
+				}
+			}
+
+			// a diff adds the files a count counts, and lists those over the size limit
+			emptyTree := "4b825dc642cb6eb9a060e54bf8d69288fbee4904" // the tree every git repository has
+			dirDiff, err := DiffDirs(context.Background(), t.TempDir(), dir, tt.opts)
+			if err != nil {
+				t.Fatalf("Failed to diff directories: %v", err)
+			}
+			revDiff, err := DiffRevisions(context.Background(), dir, emptyTree, "HEAD", tt.opts)
+			if err != nil {
+				t.Fatalf("Failed to diff revisions: %v", err)
+			}
+			for name, diff := range map[string]*DiffReport{"directory diff": dirDiff, "revision diff": revDiff} {
+				var added []string
+				for _, file := range diff.Files {
+					added = append(added, file.Path)
+				}
+				if !slices.Equal(added, tt.expected) {
+					t.Errorf("%s: expected %v to be added, got %v", name, tt.expected, added)
+				}
+				if !slices.Equal(diff.TooLarge, tt.tooLarge) {
+					t.Errorf("%s: expected %v to be too large, got %v", name, tt.tooLarge, diff.TooLarge)
+				}
+			}
+		})
+	}
+}
+
+func TestNotebooks(t *testing.T) {
+	python := `{
+ "cells": [
+  {"cell_type": "markdown", "metadata": {}, "source": ["# Orders\n", "\n", "Per month."]},
+  {"cell_type": "code", "metadata": {}, "outputs": [{"output_type": "stream", "text": ["1\n", "2\n"]}],
+   "source": ["import pandas as pd\n", "\n", "# one row per order\n", "orders = pd.read_csv(\"orders.csv\")"]},
+  {"cell_type": "raw", "metadata": {}, "source": "not counted"}
+ ],
+ "metadata": {"kernelspec": {"language": "python", "name": "python3"}, "language_info": {"name": "python", "file_extension": ".py"}},
+ "nbformat": 4
+}`
+	r := `{
+ "cells": [{"cell_type": "code", "metadata": {}, "outputs": [], "source": "x <- 1\n# plot it\nplot(x)"}],
+ "metadata": {"kernelspec": {"name": "ir"}, "language_info": {"name": "R", "file_extension": ".r"}},
+ "nbformat": 4
+}`
+	unknown := `{
+ "cells": [{"cell_type": "code", "metadata": {}, "outputs": [], "source": "main = print 1\n\n"}],
+ "metadata": {"kernelspec": {"language": "haskell"}},
+ "nbformat": 4
+}`
+	config := &Config{
+		Languages: map[string]LanguageConfig{
+			"python":  {Extensions: []string{".py"}, SkipPatterns: []string{`^\s*#`, `^\s*$`}},
+			"r":       {Extensions: []string{".r"}, SkipPatterns: []string{`^\s*#`, `^\s*$`}},
+			"jupyter": {Extensions: []string{".ipynb"}, SkipPatterns: []string{`^\s*$`}},
+		},
+	}
+	files := map[string]string{
+		"orders.ipynb":  python,
+		"plot.ipynb":    r,
+		"haskell.ipynb": unknown,
+		// notebooks that are not JSON are skipped and listed, rather than stopping the count
+		"broken.ipynb":   "{\"cells\": [",
+		"lfs.ipynb":      "version https://git-lfs.github.com/spec/v1\noid sha256:4d7a\nsize 12345\n",
+		"conflict.ipynb": "{\n<<<<<<< HEAD\n \"cells\": []\n=======\n \"cells\": [{}]\n>>>>>>> feature\n}\n",
+	}
+	fsys := make(fstest.MapFS)
+	for name, content := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+
+	expected := map[string]FileCounts{
+		"orders.ipynb":  {Path: "orders.ipynb", Language: "python", Counts: Counts{Code: 2, Comment: 3, Blank: 2}},
+		"plot.ipynb":    {Path: "plot.ipynb", Language: "r", Counts: Counts{Code: 2, Comment: 1}},
+		"haskell.ipynb": {Path: "haskell.ipynb", Language: "jupyter", Counts: Counts{Code: 1, Blank: 1}},
+	}
+	check := func(name string, report *Report) {
+		t.Helper()
+		if len(report.Files) != len(expected) {
+			t.Errorf("%s: expected %d files, got %+v", name, len(expected), report.Files)
+		}
+		for _, file := range report.Files {
+			if !reflect.DeepEqual(file, expected[file.Path]) {
+				t.Errorf("%s: expected %+v, got %+v", name, expected[file.Path], file)
+			}
+		}
+		if got := report.Languages["python"]; got != (Counts{Code: 2, Comment: 3, Blank: 2}) {
+			t.Errorf("%s: expected the code cells under python, got %+v", name, got)
+		}
+		invalid := slices.Sorted(slices.Values(report.InvalidNotebooks))
+		if expected := []string{"broken.ipynb", "conflict.ipynb", "lfs.ipynb"}; !slices.Equal(invalid, expected) {
+			t.Errorf("%s: expected %v to be skipped as invalid, got %v", name, expected, invalid)
+		}
+	}
+
+	report, err := CountFS(context.Background(), fsys, Options{Config: config, Files: true})
+	if err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	check("filesystem", report)
+
+	// the kernel language is kept in the cache, and blobs are counted the same way
+	checkCountModes(t, setupTestDirectory(t, files), Options{Config: config, Files: true}, check)
+
+	// a diff compares the cells as the kernel language, changed outputs change no line
+	changed := maps.Clone(files)
+	changed["orders.ipynb"] = strings.NewReplacer(
+		`"Per month."`, `"Per month.\n", "Per customer."`,
+		`pd.read_csv(\"orders.csv\")`, `pd.read_parquet(\"orders.parquet\")`,
+	).Replace(python)
+	changed["plot.ipynb"] = strings.Replace(r, `"outputs": []`, `"outputs": [{"output_type": "stream", "text": "1"}]`, 1)
+	changed["lfs.ipynb"] = "version https://git-lfs.github.com/spec/v1\noid sha256:9f2c\nsize 23456\n"
+	diff, err := DiffDirs(context.Background(), setupTestDirectory(t, files), setupTestDirectory(t, changed), Options{Config: config})
+	if err != nil {
+		t.Fatalf("Failed to diff: %v", err)
+	}
+	want := []FileDiff{{Path: "orders.ipynb", Language: "python", Status: "modified", DiffCounts: DiffCounts{
+		Code: LineDelta{Modified: 1}, Comment: LineDelta{Added: 1},
+	}}}
+	if !reflect.DeepEqual(diff.Files, want) {
+		t.Errorf("Expected %+v, got %+v", want, diff.Files)
+	}
+	if !slices.Equal(diff.InvalidNotebooks, []string{"lfs.ipynb"}) {
+		t.Errorf("Expected lfs.ipynb to be skipped as invalid, got %v", diff.InvalidNotebooks)
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	config := &Config{
+		Languages: map[string]LanguageConfig{
+			"html": {
+				Extensions:   []string{".html"},
+				SkipPatterns: []string{`^\s*<!--`, `^\s*$`},
+				Embedded: []EmbeddedRegion{
+					{Language: "javascript", Start: `<script\b`, End: `</script>`},
+					{Language: "css", Start: `<style\b`, End: `</style>`},
+					{Language: "php", Start: `<\?(php|=)`, End: `\?>`},
+				},
+			},
+			"vue": {
+				Extensions:   []string{".vue"},
+				SkipPatterns: []string{`^\s*<!--`, `^\s*$`},
+				Embedded: []EmbeddedRegion{
+					{Language: "typescript", Start: `<script\b[^>]*\blang="ts"`, End: `</script>`},
+					{Language: "javascript", Start: `<script\b`, End: `</script>`},
+				},
+			},
+			"javascript": {Extensions: []string{".js"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+			"typescript": {Extensions: []string{".ts"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+			"css":        {Extensions: []string{".css"}, SkipPatterns: []string{`^\s*/\*`, `^\s*$`}},
+			"php":        {Extensions: []string{".php"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+		},
+	}
+	s := &scanner{Config: config}
+
+	tests := []struct {
+		name     string
+		language string
+		content  string
+		total    Counts
+		embedded map[string]Counts
+	}{
+		{
+			name:     "no regions",
+			language: "html",
+			content:  "<html>\n<!-- empty -->\n\n</html>\n",
+			total:    Counts{Code: 2, Comment: 1, Blank: 1},
+		},
+		{
+			name:     "script and style",
+			language: "html",
+			content: "<html>\n<script>\n// greet\nalert(1);\n\n</script>\n<style>\n/* red */\nbody { color: red; }\n</style>\n" +
+				"<script src=\"app.js\"></script>\n</html>\n",
+			total:    Counts{Code: 9, Comment: 2, Blank: 1},
+			embedded: map[string]Counts{"javascript": {Code: 1, Comment: 1, Blank: 1}, "css": {Code: 1, Comment: 1}},
+		},
+		{
+			name:     "php template",
+			language: "html",
+			content:  "<ul>\n<?php\n// every item\nforeach ($items as $item) {\n  echo $item;\n}\n?>\n<li><?= $last ?></li>\n</ul>\n",
+			total:    Counts{Code: 8, Comment: 1},
+			embedded: map[string]Counts{"php": {Code: 3, Comment: 1}},
+		},
+		{
+			name:     "unclosed region runs to the end",
+			language: "html",
+			content:  "<script>\nlet a = 1;\nlet b = 2;\n",
+			total:    Counts{Code: 3},
+			embedded: map[string]Counts{"javascript": {Code: 2}},
+		},
+		{
+			name:     "single file component",
+			language: "vue",
+			content:  "<template>\n  <p>{{ msg }}</p>\n</template>\n\n<script lang=\"ts\">\nexport default {}\n</script>\n",
+			total:    Counts{Code: 6, Blank: 1},
+			embedded: map[string]Counts{"typescript": {Code: 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, embedded, _, err := s.countText(tt.language, strings.NewReader(tt.content))
+			if err != nil {
+				t.Fatalf("Failed to count: %v", err)
+			}
+			if total != tt.total {
+				t.Errorf("Expected %+v in total, got %+v", tt.total, total)
+			}
+			if !maps.Equal(embedded, tt.embedded) {
+				t.Errorf("Expected %v embedded, got %v", tt.embedded, embedded)
+			}
+		})
+	}
+
+	// the embedded lines are counted as their language, the file keeps them all
+	fsys := fstest.MapFS{
+		"index.html": {Data: []byte(tests[1].content)},
+		"app.js":     {Data: []byte("alert(2);\n")},
+		"gen.html":   {Data: []byte("<!-- @generated -->\n<script>\nalert(3);\n</script>\n")},
+	}
+	report, err := CountFS(context.Background(), fsys, Options{Config: config, Files: true})
+	if err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	expected := map[string]Counts{
+		"html":       {Code: 7, Generated: 4},
+		"javascript": {Code: 2, Comment: 1, Blank: 1},
+		"css":        {Code: 1, Comment: 1},
+	}
+	if !maps.Equal(report.Languages, expected) {
+		t.Errorf("Expected languages %v, got %v", expected, report.Languages)
+	}
+	for _, file := range report.Files {
+		switch file.Path {
+		case "index.html":
+			if file.Language != "html" || file.Counts != tests[1].total || !maps.Equal(file.Embedded, tests[1].embedded) {
+				t.Errorf("Expected index.html to hold every line, got %+v", file)
+			}
+		case "gen.html":
+			if file.Embedded != nil {
+				t.Errorf("Expected every line of gen.html to be generated html, got %+v", file)
+			}
+		}
+	}
+
+	// cached files and blobs keep their embedded lines
+	files := make(map[string]string)
+	for name, file := range fsys {
+		files[name] = string(file.Data)
+	}
+	checkCountModes(t, setupTestDirectory(t, files), Options{Config: config}, func(name string, got *Report) {
+		t.Helper()
+		if !maps.Equal(got.Languages, expected) {
+			t.Errorf("%s: expected languages %v, got %v", name, expected, got.Languages)
+		}
+	})
+
+	// a diff splits the lines of a page between its languages the same way
+	changed := maps.Clone(files)
+	changed["index.html"] = strings.NewReplacer("<html>", `<html lang="en">`, "alert(1);", "alert(2);\nconsole.log(2);").Replace(files["index.html"])
+	diff, err := DiffDirs(context.Background(), setupTestDirectory(t, files), setupTestDirectory(t, changed), Options{Config: config})
+	if err != nil {
+		t.Fatalf("Failed to diff: %v", err)
+	}
+	script := DiffCounts{Code: LineDelta{Added: 1, Modified: 1}}
+	page := DiffCounts{Code: LineDelta{Added: 1, Modified: 2}}
+	want := []FileDiff{{Path: "index.html", Language: "html", Status: "modified", DiffCounts: page, Embedded: map[string]DiffCounts{"javascript": script}}}
+	if !reflect.DeepEqual(diff.Files, want) {
+		t.Errorf("Expected %+v, got %+v", want, diff.Files)
+	}
+	if diff.Languages["javascript"] != script || diff.Languages["html"] != (DiffCounts{Code: LineDelta{Modified: 1}}) {
+		t.Errorf("Expected the script lines under javascript, got %+v", diff.Languages)
+	}
+
+	// an embedded language must be configured
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"languages": {"html": {"extensions": [".html"],
+		"embedded": [{"language": "coffeescript", "start": "<script", "end": "</script>"}]}}}`), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Error("Expected an error for an embedded language that is not configured")
+	}
+}
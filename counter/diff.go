@@ -0,0 +1,503 @@
+// loc - line count differences between two revisions or directories
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LineDelta is the number of lines added, removed and modified between two versions of a file
+type LineDelta struct {
+	Added    int `json:"added"`    // Lines only in the new version
+	Removed  int `json:"removed"`  // Lines only in the old version
+	Modified int `json:"modified"` // Lines changed in place, paired up within a changed hunk
+}
+
+// add adds the counts of other to d
+func (d *LineDelta) add(other LineDelta) {
+	d.Added += other.Added
+	d.Removed += other.Removed
+	d.Modified += other.Modified
+}
+
+// DiffCounts is the line delta of each line classification
+type DiffCounts struct {
+	Code    LineDelta `json:"code"`    // Lines of code
+	Comment LineDelta `json:"comment"` // Comment lines
+	Blank   LineDelta `json:"blank"`   // Blank lines
+}
+
+// add adds the counts of other to c
+func (c *DiffCounts) add(other DiffCounts) {
+	c.Code.add(other.Code)
+	c.Comment.add(other.Comment)
+	c.Blank.add(other.Blank)
+}
+
+// FileDiff is the line delta of a single file
+type FileDiff struct {
+	Path       string `json:"path"`     // Slash separated path relative to the compared trees
+	Language   string `json:"language"` // The language the file is counted as
+	Status     string `json:"status"`   // added, removed or modified
+	DiffCounts        // The line delta of the file
+
+	Embedded map[string]DiffCounts `json:"embedded,omitempty"` // Line delta of embedded languages, such as the scripts of an HTML page, which is part of DiffCounts
+}
+
+// DiffReport is the line delta between two trees
+type DiffReport struct {
+	Files     []FileDiff            `json:"files"`               // Changed files, sorted by path
+	Languages map[string]DiffCounts `json:"languages"`           // Line delta per language
+	Total     DiffCounts            `json:"total"`               // Line delta of all files
+	Binary    []string              `json:"binary,omitempty"`    // Changed files skipped as binary, on either side
+	TooLarge  []string              `json:"too_large,omitempty"` // Changed files skipped for being over Options.MaxFileSize, on either side
+
+	InvalidNotebooks []string `json:"invalid_notebooks,omitempty"` // Changed notebooks skipped for not being valid JSON, on either side
+}
+
+// diffFile is a file on one side of a diff
+type diffFile struct {
+	key      string                 // Identifies the contents, files with the same non empty key are unchanged
+	read     func() ([]byte, error) // Reads the contents of the file
+	tooLarge bool                   // Whether the file is over the size limit, it is not read then
+}
+
+// treeFiles lists the files of a git revision that are not excluded, keyed by slash separated path
+func (s *scanner) treeFiles(ctx context.Context, catFile *gitCatFile, rev string) (map[string]diffFile, error) {
+	entries, err := gitTree(ctx, s.Directory, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]diffFile)
+	for _, entry := range entries {
+		// apply the same rules as the directory walk
+		if s.shouldExcludeTreePath(filepath.Join(s.Directory, filepath.FromSlash(entry.Path))) || s.outOfBoundsFile(entry.Path) || s.skipVendoredFile(entry.Path) {
+			continue
+		}
+		hash := entry.Hash
+		files[entry.Path] = diffFile{key: hash, tooLarge: s.maxFileSize > 0 && entry.Size > s.maxFileSize, read: func() ([]byte, error) {
+			return catFile.read(hash)
+		}}
+	}
+
+	return files, nil
+}
+
+// dirFiles lists the files of the directory that are not excluded, keyed by slash separated path
+func (s *scanner) dirFiles(ctx context.Context) (map[string]diffFile, error) {
+	files := make(map[string]diffFile)
+	err := s.walk(ctx, func(name string) error {
+		file := diffFile{read: func() ([]byte, error) {
+			return fs.ReadFile(s.FS, name)
+		}}
+		if s.maxFileSize > 0 {
+			info, err := fs.Stat(s.FS, name)
+			if err != nil {
+				return err
+			}
+			file.tooLarge = info.Size() > s.maxFileSize
+		}
+		files[name] = file
+		return nil
+	})
+	return files, err
+}
+
+// diff compares the files of two trees and reports the line delta of every changed file the config knows about
+func (s *scanner) diff(oldFiles, newFiles map[string]diffFile) (*DiffReport, error) {
+	// collect the paths on either side in a stable order
+	var paths []string
+	for path := range oldFiles {
+		paths = append(paths, path)
+	}
+	for path := range newFiles {
+		if _, ok := oldFiles[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	report := &DiffReport{Languages: make(map[string]DiffCounts)}
+	for _, path := range paths {
+		oldFile, inOld := oldFiles[path]
+		newFile, inNew := newFiles[path]
+		if inOld && inNew && oldFile.key != "" && oldFile.key == newFile.key { // unchanged blob
+			continue
+		}
+
+		language := s.Config.DetectLanguage(path)
+		if language == "" { // not a file we count
+			continue
+		}
+		if oldFile.tooLarge || newFile.tooLarge { // skipped by size, without reading either version
+			report.TooLarge = append(report.TooLarge, path)
+			continue
+		}
+
+		var oldContent, newContent []byte
+		var err error
+		status := "modified"
+		if inOld {
+			if oldContent, err = oldFile.read(); err != nil {
+				return nil, err
+			}
+		} else {
+			status = "added"
+		}
+		if inNew {
+			if newContent, err = newFile.read(); err != nil {
+				return nil, err
+			}
+		} else {
+			status = "removed"
+		}
+		if inOld && inNew && bytes.Equal(oldContent, newContent) { // unchanged file of a directory
+			continue
+		}
+
+		// read like a count does, a data file with the extension of a language or a broken notebook is skipped
+		oldVersion, oldErr := s.splitVersion(language, oldContent, inOld)
+		newVersion, newErr := s.splitVersion(language, newContent, inNew)
+		if errors.Is(oldErr, errInvalidNotebook) || errors.Is(newErr, errInvalidNotebook) {
+			report.InvalidNotebooks = append(report.InvalidNotebooks, path)
+			continue
+		}
+		if err := cmp.Or(oldErr, newErr); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if oldVersion.binary || newVersion.binary {
+			report.Binary = append(report.Binary, path)
+			continue
+		}
+
+		file := FileDiff{Path: path, Language: newVersion.language, Status: status} // the kernel of a notebook may have changed
+		if !inNew {
+			file.Language = oldVersion.language
+		}
+		languages := make(map[string]DiffCounts) // the delta of the lines of each language, embedded or not
+		for _, lines := range []map[string]map[lineKind][]string{oldVersion.lines, newVersion.lines} {
+			for language := range lines {
+				if _, ok := languages[language]; ok {
+					continue
+				}
+				if counts := diffClassified(oldVersion.lines[language], newVersion.lines[language]); counts != (DiffCounts{}) {
+					languages[language] = counts
+				}
+			}
+		}
+		if len(languages) == 0 { // the contents differ in ways that do not change any line
+			continue
+		}
+
+		for language, counts := range languages {
+			file.DiffCounts.add(counts)
+			if language != file.Language {
+				if file.Embedded == nil {
+					file.Embedded = make(map[string]DiffCounts)
+				}
+				file.Embedded[language] = counts
+			}
+			languageCounts := report.Languages[language]
+			languageCounts.add(counts)
+			report.Languages[language] = languageCounts
+		}
+		report.Files = append(report.Files, file)
+		report.Total.add(file.DiffCounts)
+	}
+
+	return report, nil
+}
+
+// decodeContent decodes one version of a file to UTF-8, and reports whether it is binary instead
+func decodeContent(content []byte, encoding string) ([]byte, bool, error) {
+	body, _, binary := decode(bytes.NewReader(content), encoding)
+	if binary {
+		return nil, true, nil
+	}
+	text, err := io.ReadAll(body)
+	return text, false, err
+}
+
+// diffVersion is one version of a changed file, its lines grouped by language and classification
+type diffVersion struct {
+	language string                           // The language of the file, the kernel's for a notebook
+	lines    map[string]map[lineKind][]string // The lines of every language by classification, embedded languages included
+	binary   bool                             // Whether the version is binary, it has no lines then
+}
+
+// splitVersion reads the lines of one version of a file detected as language the way a count reads them. A
+// version that does not exist has no lines.
+func (s *scanner) splitVersion(language string, content []byte, exists bool) (diffVersion, error) {
+	version := diffVersion{language: language, lines: make(map[string]map[lineKind][]string)}
+	if !exists {
+		return version, nil
+	}
+	add := func(language, line string, kind lineKind) {
+		if version.lines[language] == nil {
+			version.lines[language] = make(map[lineKind][]string)
+		}
+		version.lines[language][kind] = append(version.lines[language][kind], line)
+	}
+
+	if language == notebookLanguage { // the cells under the kernel language, as they are counted
+		cells := make(map[lineKind][]string)
+		kernel, err := s.classifyNotebook(bytes.NewReader(content), func(line string, kind lineKind) {
+			cells[kind] = append(cells[kind], line)
+		})
+		version.language, version.lines[kernel] = kernel, cells
+		return version, err
+	}
+
+	text, binary, err := decodeContent(content, s.Config.Languages[language].Encoding)
+	if err != nil || binary {
+		version.binary = binary
+		return version, err
+	}
+	_, err = s.classifyText(language, bytes.NewReader(text), add)
+	return version, err
+}
+
+// diffClassified computes the delta of each classification between the lines of two versions of a file
+func diffClassified(oldLines, newLines map[lineKind][]string) DiffCounts {
+	var counts DiffCounts
+
+	// code and comment lines are diffed separately so a line moving between them is an add and a remove
+	counts.Code = diffLines(oldLines[lineCode], newLines[lineCode])
+	counts.Comment = diffLines(oldLines[lineComment], newLines[lineComment])
+
+	// blank lines have no content to pair up, only the change in their number is meaningful
+	blankChange := len(newLines[lineBlank]) - len(oldLines[lineBlank])
+	if blankChange > 0 {
+		counts.Blank.Added = blankChange
+	} else {
+		counts.Blank.Removed = -blankChange
+	}
+
+	return counts
+}
+
+// diffLines computes the lines added, removed and modified to turn a into b. Lines outside the longest common
+// subsequence are grouped into hunks, within a hunk removed and added lines are paired up as modified lines.
+func diffLines(a, b []string) LineDelta {
+	keptA := make([]bool, len(a))
+	keptB := make([]bool, len(b))
+	markCommon(a, b, keptA, keptB)
+
+	var delta LineDelta
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		removed, added := 0, 0
+		for i < len(a) && !keptA[i] {
+			removed++
+			i++
+		}
+		for j < len(b) && !keptB[j] {
+			added++
+			j++
+		}
+
+		modified := min(removed, added)
+		delta.Modified += modified
+		delta.Removed += removed - modified
+		delta.Added += added - modified
+
+		// both are now at a pair of common lines or at the end
+		if i < len(a) && j < len(b) {
+			i++
+			j++
+		}
+	}
+
+	return delta
+}
+
+// markCommon marks the lines of a and b that are part of their longest common subsequence, using the linear
+// space variant of Myers' O(ND) difference algorithm
+func markCommon(a, b []string, keptA, keptB []bool) {
+	// common prefix and suffix are kept as is
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		keptA[0], keptB[0] = true, true
+		a, b, keptA, keptB = a[1:], b[1:], keptA[1:], keptB[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		keptA[len(a)-1], keptB[len(b)-1] = true, true
+		a, b, keptA, keptB = a[:len(a)-1], b[:len(b)-1], keptA[:len(a)-1], keptB[:len(b)-1]
+	}
+	if len(a) == 0 || len(b) == 0 { // only insertions or deletions are left
+		return
+	}
+
+	// split on the middle snake and solve both halves
+	x, y, u, v := middleSnake(a, b)
+	for k := 0; k < u-x; k++ {
+		keptA[x+k], keptB[y+k] = true, true
+	}
+	markCommon(a[:x], b[:y], keptA[:x], keptB[:y])
+	markCommon(a[u:], b[v:], keptA[u:], keptB[v:])
+}
+
+// middleSnake finds the middle snake of an optimal edit path from a to b, the diagonal run of equal lines from
+// (x, y) to (u, v) where the paths searched forward from the start and backward from the end overlap
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+	limit := (n+m+1)/2 + 1
+	offset := limit + 1
+
+	// furthest x reached on each diagonal k = x - y, forward from the start and backward from the end
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1] // step down, an insertion
+			} else {
+				x = forward[offset+k-1] + 1 // step right, a deletion
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+
+			// the backward diagonal matching k is delta - k
+			if odd && k >= delta-(d-1) && k <= delta+(d-1) && x+backward[offset+delta-k] >= n {
+				return startX, startY, x, y
+			}
+		}
+
+		// the backward search runs forward over the reversed lines
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+
+			if !odd && k >= delta-d && k <= delta+d && x+forward[offset+delta-k] >= n {
+				return n - x, m - y, n - startX, m - startY
+			}
+		}
+	}
+
+	return 0, 0, 0, 0 // not reached, the searches always meet within limit steps
+}
+
+// MergeBase returns the best common ancestor of two revisions of the repository at dir
+func MergeBase(ctx context.Context, dir, base, head string) (string, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "merge-base", base, head).Output()
+	if err != nil {
+		return "", fmt.Errorf("git merge-base %s %s in '%s': %v", base, head, dir, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// DiffRevisions reports the line delta between two revisions of the repository at root, limited to root when
+// it is a subdirectory of the repository
+func DiffRevisions(ctx context.Context, root, base, head string, opts Options) (*DiffReport, error) {
+	s, err := opts.newScanner(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	catFile, err := newGitCatFile(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	defer func(catFile *gitCatFile) {
+		_ = catFile.close()
+	}(catFile)
+
+	oldFiles, err := s.treeFiles(ctx, catFile, base)
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := s.treeFiles(ctx, catFile, head)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.diff(oldFiles, newFiles)
+}
+
+// DiffDirs reports the line delta between two directories
+func DiffDirs(ctx context.Context, oldRoot, newRoot string, opts Options) (*DiffReport, error) {
+	oldScanner, err := opts.newScanner(ctx, oldRoot)
+	if err != nil {
+		return nil, err
+	}
+	newScanner, err := opts.newScanner(ctx, newRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := oldScanner.useDir(oldRoot); err != nil {
+		return nil, err
+	}
+	if err := newScanner.useDir(newRoot); err != nil {
+		return nil, err
+	}
+
+	oldFiles, err := oldScanner.dirFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := newScanner.dirFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newScanner.diff(oldFiles, newFiles)
+}
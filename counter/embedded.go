@@ -0,0 +1,177 @@
+// loc - counting of languages embedded in other languages
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// embeddedRegion is a compiled EmbeddedRegion
+type embeddedRegion struct {
+	language    string
+	start, end  *regexp.Regexp
+	skipRegexps []*regexp.Regexp // skip patterns of the embedded language
+}
+
+// compileEmbedded compiles the embedded regions of a language, checking that their languages are configured
+func compileEmbedded(config *Config, regions []EmbeddedRegion) ([]embeddedRegion, error) {
+	compiled := make([]embeddedRegion, 0, len(regions))
+	for _, region := range regions {
+		langConfig, ok := config.Languages[region.Language]
+		if !ok {
+			return nil, fmt.Errorf("embedded language '%s' is not configured", region.Language)
+		}
+		start, err := regexp.Compile(region.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid embedded start pattern '%s': %v", region.Start, err)
+		}
+		end, err := regexp.Compile(region.End)
+		if err != nil {
+			return nil, fmt.Errorf("invalid embedded end pattern '%s': %v", region.End, err)
+		}
+		skipRegexps, err := compileSkipPatterns(langConfig.SkipPatterns)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, embeddedRegion{language: region.Language, start: start, end: end, skipRegexps: skipRegexps})
+	}
+	return compiled, nil
+}
+
+// languageEmbedded returns the compiled embedded regions of a language, compiling them on first use
+func (s *scanner) languageEmbedded(language string) ([]embeddedRegion, error) {
+	if regions, ok := s.embedded[language]; ok {
+		return regions, nil
+	}
+
+	regions, err := compileEmbedded(s.Config, s.Config.Languages[language].Embedded)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.embedded == nil {
+		s.embedded = make(map[string][]embeddedRegion)
+	}
+	s.embedded[language] = regions
+	return regions, nil
+}
+
+// countText counts the lines of text read from r as the given language, returning the lines of all languages,
+// those of embedded languages by language, and the line ending style
+func (s *scanner) countText(language string, r io.Reader) (Counts, map[string]Counts, string, error) {
+	var total Counts
+	var embedded map[string]Counts
+	endings, err := s.classifyText(language, r, func(lineLanguage, line string, kind lineKind) {
+		total.addLine(kind)
+		if lineLanguage == language {
+			return
+		}
+		if embedded == nil {
+			embedded = make(map[string]Counts)
+		}
+		counts := embedded[lineLanguage]
+		counts.addLine(kind)
+		embedded[lineLanguage] = counts
+	})
+	if err != nil {
+		return Counts{}, nil, "", err
+	}
+	return total, embedded, endings.style(), nil
+}
+
+// classifyText reads the lines of text from r as the given language and calls fn with every line, the language
+// it is counted as and its classification. It returns the line endings that were seen.
+func (s *scanner) classifyText(language string, r io.Reader, fn func(language, line string, kind lineKind)) (lineEndings, error) {
+	skipRegexps, err := s.languageSkipRegexps(language)
+	if err != nil {
+		return 0, err
+	}
+	regions, err := s.languageEmbedded(language)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(regions) == 0 {
+		return classifyLines(r, skipRegexps, func(line string, kind lineKind) {
+			fn(language, line, kind)
+		})
+	}
+	return classifyRegions(r, language, skipRegexps, regions, fn)
+}
+
+// classifyRegions reads the lines from r and calls fn with every line, classifying the lines between the start
+// and the end of an embedded region as its language. The lines holding the start and the end are those of the host.
+func classifyRegions(r io.Reader, language string, skipRegexps []*regexp.Regexp, regions []embeddedRegion, fn func(language, line string, kind lineKind)) (lineEndings, error) {
+	var endings lineEndings
+	scanner := bufio.NewScanner(r)
+	scanner.Split(splitLines(&endings))
+
+	var open *embeddedRegion // the region the current line is in
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if open != nil {
+			if open.end.MatchString(line) {
+				open = nil
+			} else {
+				fn(open.language, line, classifyLine(line, open.skipRegexps))
+				continue
+			}
+		} else {
+			for i := range regions {
+				loc := regions[i].start.FindStringIndex(line)
+				if loc != nil { // the first region that starts wins, unless it ends on the same line
+					if !regions[i].end.MatchString(line[loc[1]:]) {
+						open = &regions[i]
+					}
+					break
+				}
+			}
+		}
+
+		fn(language, line, classifyLine(line, skipRegexps))
+	}
+
+	return endings, scanner.Err()
+}
+
+// minus returns the counts without the other counts
+func (c Counts) minus(other Counts) Counts {
+	return Counts{
+		Code:      c.Code - other.Code,
+		Comment:   c.Comment - other.Comment,
+		Blank:     c.Blank - other.Blank,
+		Generated: c.Generated - other.Generated,
+	}
+}
@@ -0,0 +1,237 @@
+// loc - detection and decoding of text encodings
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encodings a language may be configured with. Files of languages without one are detected by their
+// byte order mark, or as UTF-16 by the zero bytes of mostly ASCII text, and are otherwise UTF-8, or
+// Latin-1 when they are not valid UTF-8.
+const (
+	encodingUTF8    = "utf-8"
+	encodingUTF16LE = "utf-16le"
+	encodingUTF16BE = "utf-16be"
+	encodingUTF32LE = "utf-32le"
+	encodingUTF32BE = "utf-32be"
+	encodingLatin1  = "latin-1"
+)
+
+// encodings are the encodings a language may be configured with
+var encodings = []string{encodingUTF8, encodingUTF16LE, encodingUTF16BE, encodingUTF32LE, encodingUTF32BE, encodingLatin1}
+
+// byteOrderMarks are the byte order marks of the encodings that have one, UTF-32LE before UTF-16LE as it
+// starts the same way
+var byteOrderMarks = []struct {
+	encoding string
+	bom      []byte
+}{
+	{encodingUTF8, []byte{0xef, 0xbb, 0xbf}},
+	{encodingUTF32LE, []byte{0xff, 0xfe, 0x00, 0x00}},
+	{encodingUTF32BE, []byte{0x00, 0x00, 0xfe, 0xff}},
+	{encodingUTF16LE, []byte{0xff, 0xfe}},
+	{encodingUTF16BE, []byte{0xfe, 0xff}},
+}
+
+// minUTF16Zeros is the share of code units with a zero high byte above which a block without a byte
+// order mark is taken for UTF-16, as it is for text that is mostly ASCII
+const minUTF16Zeros = 0.4
+
+// checkEncoding checks that an encoding from the config is known, an empty encoding is detected
+func checkEncoding(encoding string) error {
+	if encoding == "" {
+		return nil
+	}
+	for _, known := range encodings {
+		if encoding == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown encoding '%s', expected one of %v", encoding, encodings)
+}
+
+// detectEncoding detects the encoding of a file from its first block, returning the size of its byte
+// order mark. It returns an empty encoding when the block is neither marked nor looks like UTF-16.
+func detectEncoding(block []byte) (string, int) {
+	for _, mark := range byteOrderMarks {
+		if bytes.HasPrefix(block, mark.bom) {
+			return mark.encoding, len(mark.bom)
+		}
+	}
+
+	// ASCII text in UTF-16 has a zero byte in nearly every code unit, always on the same side
+	units := len(block) / 2
+	if units < 2 {
+		return "", 0
+	}
+	zeros := [2]int{}
+	for i := 0; i < units*2; i++ {
+		if block[i] == 0 {
+			zeros[i%2]++
+		}
+	}
+	switch {
+	case float64(zeros[1]) > minUTF16Zeros*float64(units) && zeros[0] == 0:
+		return encodingUTF16LE, 0
+	case float64(zeros[0]) > minUTF16Zeros*float64(units) && zeros[1] == 0:
+		return encodingUTF16BE, 0
+	}
+	return "", 0
+}
+
+// decode returns the text read from r as UTF-8 along with its first block, for the generated markers.
+// The encoding is detected unless one is given. It reports binary files, of which only the first block
+// is read.
+func decode(r io.Reader, encoding string) (io.Reader, []byte, bool) {
+	body, header := peekHeader(r)
+
+	// a byte order mark is skipped, also when it is that of the encoding given
+	bom := 0
+	if detected, size := detectEncoding(header); encoding == "" || encoding == detected {
+		encoding, bom = detected, size
+	}
+
+	switch encoding {
+	case "":
+		if isBinary(header) {
+			return nil, nil, true
+		}
+		encoding = encodingUTF8
+		if invalidUTF8(header) > 0 { // legacy text, where every byte is a character
+			encoding = encodingLatin1
+		}
+	case encodingUTF8:
+		if isBinary(header[bom:]) {
+			return nil, nil, true
+		}
+	case encodingLatin1:
+		if bytes.IndexByte(header, 0) >= 0 { // any byte is Latin-1, but text has no NULs
+			return nil, nil, true
+		}
+	}
+
+	_, _ = body.Discard(bom)
+	if encoding == encodingUTF8 {
+		return body, header[bom:], false
+	}
+
+	// UTF-16 and UTF-32 are sniffed once decoded, their zero bytes are part of the encoding
+	body, header = peekHeader(&decoder{r: body, encoding: encoding})
+	return body, header, encoding != encodingLatin1 && isBinary(header)
+}
+
+// decoder decodes UTF-16, UTF-32 or Latin-1 text to UTF-8
+type decoder struct {
+	r        *bufio.Reader
+	encoding string
+	unit     [4]byte // the code unit being read
+	pending  []byte  // decoded text that did not fit the last read
+}
+
+// Read implements io.Reader
+func (d *decoder) Read(p []byte) (int, error) {
+	for len(d.pending) < len(p) {
+		r, err := d.next()
+		if err != nil {
+			if len(d.pending) > 0 { // the error is returned again by the next read
+				break
+			}
+			return 0, err
+		}
+		d.pending = utf8.AppendRune(d.pending, r)
+	}
+
+	n := copy(p, d.pending)
+	d.pending = append(d.pending[:0], d.pending[n:]...)
+	return n, nil
+}
+
+// next decodes the next character, a code unit cut off at the end is dropped
+func (d *decoder) next() (rune, error) {
+	switch d.encoding {
+	case encodingLatin1:
+		b, err := d.r.ReadByte()
+		return rune(b), err
+	case encodingUTF32LE, encodingUTF32BE:
+		if _, err := io.ReadFull(d.r, d.unit[:4]); err != nil {
+			return 0, eof(err)
+		}
+		var r rune
+		if d.encoding == encodingUTF32LE {
+			r = rune(binary.LittleEndian.Uint32(d.unit[:4]))
+		} else {
+			r = rune(binary.BigEndian.Uint32(d.unit[:4]))
+		}
+		if !utf8.ValidRune(r) {
+			return utf8.RuneError, nil
+		}
+		return r, nil
+	}
+
+	r, err := d.next16()
+	if err != nil || !utf16.IsSurrogate(r) {
+		return r, err
+	}
+	if r >= 0xdc00 { // the second half of a pair without the first
+		return utf8.RuneError, nil
+	}
+	low, err := d.next16() // the second half of a surrogate pair
+	if err != nil {
+		return utf8.RuneError, nil
+	}
+	return utf16.DecodeRune(r, low), nil
+}
+
+// next16 reads the next UTF-16 code unit
+func (d *decoder) next16() (rune, error) {
+	if _, err := io.ReadFull(d.r, d.unit[:2]); err != nil {
+		return 0, eof(err)
+	}
+	if d.encoding == encodingUTF16LE {
+		return rune(binary.LittleEndian.Uint16(d.unit[:2])), nil
+	}
+	return rune(binary.BigEndian.Uint16(d.unit[:2])), nil
+}
+
+// eof turns the end of the text in the middle of a code unit into the end of the text
+func eof(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
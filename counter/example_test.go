@@ -0,0 +1,97 @@
+// loc counter examples
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"loc/counter"
+)
+
+// goConfig counts Go, skipping comments and blank lines
+var goConfig = &counter.Config{Languages: map[string]counter.LanguageConfig{
+	"go": {Extensions: []string{".go"}, SkipPatterns: []string{`^\s*//`, `^\s*$`}},
+}}
+
+func ExampleCount() {
+	dir, err := os.MkdirTemp("", "loc-example-")
+	if err != nil {
+		panic(err)
+	}
+	defer func(path string) {
+		_ = os.RemoveAll(path)
+	}(dir)
+
+	_ = os.WriteFile(filepath.Join(dir, "main.go"), []byte("// main\npackage main\n\nfunc main() {\n}\n"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "main_test.go"), []byte("package main\n"), 0644)
+
+	report, err := counter.Count(context.Background(), dir, counter.Options{
+		Config:          goConfig,
+		ExcludePatterns: []string{`_test\.go$`},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("code: %d, comment: %d, blank: %d\n", report.Total.Code, report.Total.Comment, report.Total.Blank)
+	// Output: code: 3, comment: 1, blank: 1
+}
+
+func ExampleCountReader() {
+	source := "// Package demo is a demo\npackage demo\n\nvar answer = 42\n"
+
+	counts, err := counter.CountReader(goConfig.Languages["go"], strings.NewReader(source))
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("code: %d, comment: %d, blank: %d\n", counts.Code, counts.Comment, counts.Blank)
+	// Output: code: 2, comment: 1, blank: 1
+}
+
+func ExampleLoadConfig() {
+	config, err := counter.LoadConfig(filepath.Join("..", counter.ConfigFile))
+	if err != nil {
+		panic(err)
+	}
+
+	for _, path := range []string{"main.go", "include/header.h", "README.md"} {
+		fmt.Printf("%s: %q\n", path, config.DetectLanguage(path))
+	}
+	// Output:
+	// main.go: "go"
+	// include/header.h: "c"
+	// README.md: ""
+}
@@ -0,0 +1,178 @@
+// loc - detection of generated files
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+)
+
+// generatedHeaderSize is how much of the start of a file is searched for a generated file marker
+const generatedHeaderSize = 4096
+
+// defaultGeneratedHeaders mark generated files in any language. Markers must start a comment, so code
+// that merely mentions them, like this file, is not taken for generated.
+var defaultGeneratedHeaders = []string{
+	`^\s*(//|#|--|;|/?\*|<!--)\s*Code generated .* DO NOT EDIT\.?`, // the Go convention, also used by many other generators
+	`^\s*(//|#|--|;|/?\*|<!--)\s*@generated\b`,
+	`(?i)^\s*(//|#|--|;|/?\*|<!--)\s*(this file (is|was) )?auto-?generated\b.*\bdo not (edit|modify)`,
+}
+
+// defaultGeneratedFiles match the base names of generated files and lockfiles in any language
+var defaultGeneratedFiles = []string{
+	`\.pb\.(go|cc|h)$`,
+	`_pb2(_grpc)?\.py$`,
+	`^zz_generated\.`,
+	`[._]generated\.\w+$`,
+	`\.min\.(js|css)$`,
+	`^(package-lock\.json|npm-shrinkwrap\.json|yarn\.lock|pnpm-lock\.yaml|Cargo\.lock|Gemfile\.lock|composer\.lock|poetry\.lock|Pipfile\.lock|go\.sum)$`,
+}
+
+// generatedPatterns are the compiled patterns recognising the generated files of a language
+type generatedPatterns struct {
+	headers []*regexp.Regexp // Matched against the lines at the start of a file
+	files   []*regexp.Regexp // Matched against the base name of a file
+}
+
+// compilePatterns compiles regular expressions, naming the kind of pattern in errors
+func compilePatterns(kind string, patterns ...[]string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, list := range patterns {
+		for _, pattern := range list {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s pattern '%s': %v", kind, pattern, err)
+			}
+			compiled = append(compiled, re)
+		}
+	}
+	return compiled, nil
+}
+
+// compileGeneratedPatterns compiles the built-in patterns together with those of a language
+func compileGeneratedPatterns(lang LanguageConfig) (generatedPatterns, error) {
+	headers, err := compilePatterns("generated header", defaultGeneratedHeaders, lang.GeneratedHeaders)
+	if err != nil {
+		return generatedPatterns{}, err
+	}
+	files, err := compilePatterns("generated file", defaultGeneratedFiles, lang.GeneratedFiles)
+	if err != nil {
+		return generatedPatterns{}, err
+	}
+	return generatedPatterns{headers: headers, files: files}, nil
+}
+
+// matchesName reports whether the name of a file is that of a generated file
+func (p generatedPatterns) matchesName(name string) bool {
+	base := path.Base(name)
+	for _, re := range p.files {
+		if re.MatchString(base) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesHeader reports whether the start of a file marks it as generated
+func (p generatedPatterns) matchesHeader(header []byte) bool {
+	if len(header) > generatedHeaderSize {
+		header = header[:generatedHeaderSize]
+	}
+
+	for len(header) > 0 {
+		line := header
+		if i := bytes.IndexByte(header, '\n'); i >= 0 {
+			line, header = header[:i], header[i+1:]
+		} else {
+			header = nil
+		}
+		for _, re := range p.headers {
+			if re.Match(line) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// languageGeneratedPatterns returns the compiled generated file patterns of a language, compiling them on first use
+func (s *scanner) languageGeneratedPatterns(language string) (generatedPatterns, error) {
+	if patterns, ok := s.generatedPatterns[language]; ok {
+		return patterns, nil
+	}
+
+	patterns, err := compileGeneratedPatterns(s.Config.Languages[language])
+	if err != nil {
+		return generatedPatterns{}, err
+	}
+	if s.generatedPatterns == nil {
+		s.generatedPatterns = make(map[string]generatedPatterns)
+	}
+	s.generatedPatterns[language] = patterns
+	return patterns, nil
+}
+
+// isGenerated reports whether the file name in a language starting with header is generated. Generated
+// files are always counted as written when CountGenerated is set.
+func (s *scanner) isGenerated(name, language string, header []byte) (bool, error) {
+	if s.countGenerated {
+		return false, nil
+	}
+	patterns, err := s.languageGeneratedPatterns(language)
+	if err != nil {
+		return false, err
+	}
+	return patterns.matchesName(name) || patterns.matchesHeader(header), nil
+}
+
+// peekHeader returns a reader for r and the start of what it reads, to look for generated file markers
+func peekHeader(r io.Reader) (*bufio.Reader, []byte) {
+	br := bufio.NewReaderSize(r, generatedHeaderSize)
+	header, _ := br.Peek(generatedHeaderSize) // shorter files are peeked whole
+	return br, header
+}
+
+// asGenerated moves every line of a generated file to the generated column
+func (c Counts) asGenerated() Counts {
+	return Counts{Generated: c.Code + c.Comment + c.Blank + c.Generated}
+}
+
+// asGenerated moves every line of a generated file to the generated column of its language, embedded
+// languages included
+func (f FileCounts) asGenerated() FileCounts {
+	f.Counts = f.Counts.asGenerated()
+	f.Embedded = nil
+	return f
+}
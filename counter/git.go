@@ -0,0 +1,361 @@
+// loc - read files to count from git
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// gitTrackedFiles lists the files git tracks in dir, optionally including untracked files that are not ignored
+func gitTrackedFiles(ctx context.Context, dir string, includeUntracked bool) (map[string]bool, error) {
+	args := []string{"-C", dir, "ls-files", "-z", "--cached"}
+	if includeUntracked {
+		args = append(args, "--others", "--exclude-standard") // untracked files that are not ignored
+	}
+
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files in '%s': %v", dir, err)
+	}
+
+	files := make(map[string]bool)
+	for _, name := range strings.Split(string(out), "\x00") { // entries are NUL terminated
+		if name == "" {
+			continue
+		}
+		// record the file and every directory leading up to it so the walk can descend into them
+		for p := filepath.FromSlash(name); p != "." && !files[p]; p = filepath.Dir(p) {
+			files[p] = true
+		}
+	}
+
+	return files, nil
+}
+
+// gitTreeEntry is a file in the tree of a git revision
+type gitTreeEntry struct {
+	Hash string // The blob object name
+	Path string // Slash separated path relative to the directory the tree was listed from
+	Size int64  // Size of the blob in bytes
+}
+
+// gitTree lists the files in the tree of a revision, limited to dir when dir is a subdirectory of the repository
+func gitTree(ctx context.Context, dir, rev string) ([]gitTreeEntry, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "ls-tree", "-r", "-l", "-z", rev).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-tree %s in '%s': %v", rev, dir, err)
+	}
+
+	var entries []gitTreeEntry
+	for _, line := range strings.Split(string(out), "\x00") { // entries are NUL terminated
+		// each entry looks like "<mode> SP <type> SP <object> SP <padded size> TAB <path>"
+		meta, path, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(meta)
+		if len(fields) != 4 || fields[1] != "blob" || fields[0] == "120000" { // skip submodules and symlinks
+			continue
+		}
+		size, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("git ls-tree: bad size in %q", meta)
+		}
+		entries = append(entries, gitTreeEntry{Hash: fields[2], Path: path, Size: size})
+	}
+
+	return entries, nil
+}
+
+// gitCatFile reads blobs from the object store through a single git cat-file --batch process
+type gitCatFile struct {
+	cmd    *exec.Cmd      // The running git cat-file process
+	stdin  io.WriteCloser // Object names are written here
+	stdout *bufio.Reader  // Object contents are read from here
+}
+
+// newGitCatFile starts git cat-file --batch in dir, the process is killed when ctx is done
+func newGitCatFile(ctx context.Context, dir string) (*gitCatFile, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", dir, "cat-file", "--batch")
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("git cat-file in '%s': %v", dir, err)
+	}
+
+	return &gitCatFile{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// read returns the contents of a blob
+func (c *gitCatFile) read(hash string) ([]byte, error) {
+	if _, err := io.WriteString(c.stdin, hash+"\n"); err != nil {
+		return nil, err
+	}
+
+	// the header looks like "<object> SP <type> SP <size> LF", or "<object> SP missing LF"
+	header, err := c.stdout.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("git cat-file: object %s %s", hash, strings.TrimSpace(strings.Join(fields[1:], " ")))
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("git cat-file: bad header %q", header)
+	}
+
+	// the contents are followed by a LF which we discard
+	content := make([]byte, size+1)
+	if _, err := io.ReadFull(c.stdout, content); err != nil {
+		return nil, err
+	}
+
+	return content[:size], nil
+}
+
+// close stops the git cat-file process
+func (c *gitCatFile) close() error {
+	_ = c.stdin.Close() // git cat-file exits once its input is closed
+	return c.cmd.Wait()
+}
+
+// scanRevision counts the lines of code in the tree of a git revision without checking it out
+func (s *scanner) scanRevision(ctx context.Context, rev string) error {
+	catFile, err := newGitCatFile(ctx, s.Directory)
+	if err != nil {
+		return err
+	}
+	defer func(catFile *gitCatFile) {
+		_ = catFile.close()
+	}(catFile)
+
+	return s.scanTree(ctx, catFile, rev, nil)
+}
+
+// scanTree counts the lines of code in the tree of a git revision, reading blobs through catFile.
+// When cache is not nil it holds the counts per language and blob, without a path, so blobs shared
+// between revisions are only read and counted once.
+func (s *scanner) scanTree(ctx context.Context, catFile *gitCatFile, rev string, cache map[string]FileCounts) error {
+	entries, err := gitTree(ctx, s.Directory, rev)
+	if err != nil {
+		return err
+	}
+
+	s.progress.FilesTotal = 0 // only the entries visited below
+	for _, entry := range entries {
+		if s.listed(entry.Path) {
+			s.progress.FilesTotal++
+		}
+	}
+	for _, entry := range entries {
+		path := filepath.Join(s.Directory, filepath.FromSlash(entry.Path))
+
+		// apply the same rules as the directory walk
+		if s.shouldExcludeTreePath(path) || s.outOfBoundsFile(entry.Path) || s.skipVendoredFile(entry.Path) {
+			continue
+		}
+		s.visit(entry.Path)
+
+		language := s.Config.DetectLanguage(path)
+		if language == "" || s.overSizeLimit(entry.Path, entry.Size) { // avoid reading blobs we would not count
+			s.emit()
+			continue
+		}
+
+		patterns, err := s.languageGeneratedPatterns(language)
+		if err != nil {
+			return err
+		}
+
+		key := language + " " + entry.Hash // the same blob may be counted as different languages
+		blob, ok := cache[key]
+		var size int64 // bytes read, nothing for a cached blob
+		if !ok {
+			content, err := catFile.read(entry.Hash)
+			if err != nil {
+				return err
+			}
+
+			if language == notebookLanguage { // the cells are counted as the language of the kernel
+				blob.Language, blob.Counts, err = s.countNotebook(bytes.NewReader(content))
+				if errors.Is(err, errInvalidNotebook) { // listed like a file on disk
+					s.skipInvalidNotebook(entry.Path)
+					s.emit()
+					continue
+				} else if err != nil {
+					return fmt.Errorf("%s: %v", entry.Path, err)
+				}
+			} else {
+				body, header, binary := decode(bytes.NewReader(content), s.Config.Languages[language].Encoding)
+				if binary { // sniffed like a file on disk
+					s.skipBinary(entry.Path)
+					s.emit()
+					continue
+				}
+
+				blob.Language = language
+				blob.Counts, blob.Embedded, blob.LineEndings, err = s.countText(language, body)
+				if err != nil {
+					return err
+				}
+				if !s.countGenerated && patterns.matchesHeader(header) { // the marker is part of the blob
+					blob = blob.asGenerated()
+				}
+			}
+			if cache != nil {
+				cache[key] = blob
+			}
+			size = int64(len(content))
+		}
+
+		// the same blob may be generated under one name and not under another
+		file := blob
+		file.Path = entry.Path
+		if !s.countGenerated && patterns.matchesName(entry.Path) {
+			file = file.asGenerated()
+		}
+
+		s.record(file)
+		s.counted(size, file.Counts)
+		s.emit()
+	}
+
+	return nil
+}
+
+// CloneOptions are the options for cloning a repository
+type CloneOptions struct {
+	Ref        string // Branch, tag or commit to check out; the default branch when empty
+	Depth      int    // Number of commits of history to fetch; the full history when 0
+	Submodules bool   // Check out submodules recursively
+}
+
+// NormalizeRepoURL turns the short host/owner/repo form and local paths into URLs git can clone from
+func NormalizeRepoURL(repo string) (string, error) {
+	if strings.Contains(repo, "://") { // already a URL, e.g. https://, ssh:// or file://
+		return repo, nil
+	}
+
+	// scp-like syntax such as git@github.com:owner/repo.git
+	if at, colon := strings.Index(repo, "@"), strings.Index(repo, ":"); at > 0 && colon > at && !strings.Contains(repo[:colon], "/") {
+		return repo, nil
+	}
+
+	// a local repository, cloned through file:// so the depth is honoured
+	if _, err := os.Stat(repo); err == nil {
+		absPath, err := filepath.Abs(repo)
+		if err != nil {
+			return "", err
+		}
+		return "file://" + filepath.ToSlash(absPath), nil
+	}
+
+	// the short host/owner/repo form, e.g. github.com/owner/repo
+	if host, _, ok := strings.Cut(repo, "/"); ok && strings.Contains(host, ".") {
+		return "https://" + repo, nil
+	}
+
+	return "", fmt.Errorf("unrecognised repository '%s', expected a URL, host/owner/repo or a local path", repo)
+}
+
+// Clone clones a repository to a temporary directory, which the caller removes when done. The directory
+// is removed again when cloning fails or ctx is cancelled, e.g. by a timeout.
+func Clone(ctx context.Context, repo string, opts CloneOptions) (string, error) {
+	repoURL, err := NormalizeRepoURL(repo)
+	if err != nil {
+		return "", err
+	}
+
+	tempDir, err := os.MkdirTemp("", "loc-repo-") // create a temporary directory
+	if err != nil {
+		return "", err
+	}
+
+	var depthArgs []string
+	if opts.Depth > 0 {
+		depthArgs = []string{"--depth", strconv.Itoa(opts.Depth)}
+	}
+
+	var commands [][]string
+	if opts.Ref == "" {
+		commands = append(commands, append([]string{"clone", "--quiet"}, append(depthArgs, repoURL, tempDir)...))
+	} else {
+		// fetch the ref on its own, which works for commits as well as branches and tags
+		commands = append(commands,
+			[]string{"init", "--quiet", tempDir},
+			append([]string{"-C", tempDir, "fetch", "--quiet"}, append(depthArgs, repoURL, opts.Ref)...),
+			[]string{"-C", tempDir, "checkout", "--quiet", "FETCH_HEAD"},
+		)
+	}
+	if opts.Submodules {
+		commands = append(commands, append([]string{"-C", tempDir, "submodule", "update", "--quiet", "--init", "--recursive"}, depthArgs...))
+	}
+
+	for _, args := range commands {
+		subcommand := args[0]
+		if subcommand == "-C" { // the steps after init run in the clone
+			subcommand = args[2]
+		}
+
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			_ = os.RemoveAll(tempDir) // also when interrupted, a partial clone is of no use
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			return "", fmt.Errorf("git %s: %v: %s", subcommand, err, strings.TrimSpace(stderr.String()))
+		}
+	}
+
+	return tempDir, nil
+}
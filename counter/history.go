@@ -0,0 +1,207 @@
+// loc - line count history of a git repository
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// gitCommit is a commit in the history of a repository
+type gitCommit struct {
+	Hash string    // The commit object name
+	Date time.Time // The committer date
+}
+
+// Sample is the line count of the tree at a commit
+type Sample struct {
+	Commit     string         `json:"commit"`      // The sampled commit
+	Date       time.Time      `json:"date"`        // The committer date of the sampled commit
+	TotalLines int            `json:"total_lines"` // Total number of lines of code
+	Languages  map[string]int `json:"languages"`   // Lines of code per language
+}
+
+// historyIntervals are the supported sampling intervals, mapped to a function returning the period a date falls in
+var historyIntervals = map[string]func(time.Time) string{
+	"commit": nil, // every commit is sampled
+	"day": func(t time.Time) string {
+		return t.Format("2006-01-02")
+	},
+	"week": func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	},
+	"month": func(t time.Time) string {
+		return t.Format("2006-01")
+	},
+	"year": func(t time.Time) string {
+		return t.Format("2006")
+	},
+}
+
+// gitHistory lists the first-parent history of a revision, newest first, optionally limited to a date range
+func gitHistory(ctx context.Context, dir, rev, since, until string) ([]gitCommit, error) {
+	args := []string{"-C", dir, "log", "--first-parent", "--format=%H %cI"}
+	if since != "" {
+		args = append(args, "--since="+since)
+	}
+	if until != "" {
+		args = append(args, "--until="+until)
+	}
+	args = append(args, rev, "--") // separate the revision from paths
+
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git log %s in '%s': %v", rev, dir, err)
+	}
+
+	var commits []gitCommit
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		hash, date, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		commitDate, err := time.Parse(time.RFC3339, date)
+		if err != nil {
+			return nil, fmt.Errorf("git log: bad commit date %q", date)
+		}
+		commits = append(commits, gitCommit{Hash: hash, Date: commitDate})
+	}
+
+	return commits, nil
+}
+
+// sampleCommits picks the newest commit of every interval from a newest first history and returns them oldest first
+func sampleCommits(commits []gitCommit, every string) ([]gitCommit, error) {
+	period, ok := historyIntervals[every]
+	if !ok {
+		return nil, fmt.Errorf("invalid interval '%s', expected commit, day, week, month or year", every)
+	}
+
+	var samples []gitCommit
+	seen := make(map[string]bool) // periods that already have their newest commit
+	for _, commit := range commits {
+		if period != nil {
+			key := period(commit.Date)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		samples = append(samples, commit)
+	}
+
+	// reverse so the samples are in chronological order
+	for i, j := 0, len(samples)-1; i < j; i, j = i+1, j-1 {
+		samples[i], samples[j] = samples[j], samples[i]
+	}
+
+	return samples, nil
+}
+
+// history counts the tree at each sampled commit, reusing the counts of blobs that did not change between commits
+func (s *scanner) history(ctx context.Context, commits []gitCommit) ([]Sample, error) {
+	catFile, err := newGitCatFile(ctx, s.Directory)
+	if err != nil {
+		return nil, err
+	}
+	defer func(catFile *gitCatFile) {
+		_ = catFile.close()
+	}(catFile)
+
+	cache := make(map[string]FileCounts) // counts per language and blob
+	var samples []Sample
+	for _, commit := range commits {
+		// count every commit from scratch with the same configuration and rules
+		commitScanner := *s
+		commitScanner.Report = Report{}
+		if err := commitScanner.scanTree(ctx, catFile, commit.Hash, cache); err != nil {
+			return nil, err
+		}
+
+		sample := Sample{
+			Commit:     commit.Hash,
+			Date:       commit.Date,
+			TotalLines: commitScanner.Total.Code,
+			Languages:  make(map[string]int),
+		}
+		for language, counts := range commitScanner.Languages {
+			sample.Languages[language] = counts.Code
+		}
+		samples = append(samples, sample)
+	}
+
+	return samples, nil
+}
+
+// HistoryOptions configure a history
+type HistoryOptions struct {
+	Options        // The languages and files to count at every commit, as for a count of a revision
+	Rev     string // Revision whose first-parent history is walked, HEAD when empty
+	Since   string // Only sample commits after this date, in any format git understands
+	Until   string // Only sample commits before this date
+	Every   string // Sampling interval: commit, day, week, month or year; month when empty
+}
+
+// History counts the tree of the newest commit in every interval of the first-parent history of the
+// repository at root, returned in chronological order. Files that did not change between samples are
+// only counted once.
+func History(ctx context.Context, root string, opts HistoryOptions) ([]Sample, error) {
+	countOpts := opts.Options
+	countOpts.GitTracked, countOpts.Files, countOpts.Progress = false, false, nil // every file of a commit is tracked, only the totals are kept
+	s, err := countOpts.newScanner(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	rev, every := opts.Rev, opts.Every
+	if rev == "" {
+		rev = "HEAD"
+	}
+	if every == "" {
+		every = "month"
+	}
+
+	commits, err := gitHistory(ctx, root, rev, opts.Since, opts.Until)
+	if err != nil {
+		return nil, err
+	}
+
+	commits, err = sampleCommits(commits, every)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.history(ctx, commits)
+}
@@ -0,0 +1,127 @@
+// loc - limits on how far a walk goes
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// defaultHiddenDirs are the hidden directories that are walked without -hidden, as they commonly hold code
+var defaultHiddenDirs = []string{".github", ".gitlab", ".circleci"}
+
+// hiddenDirs returns the names of the hidden directories walked by default, the built-in ones and those of the config
+func hiddenDirs(config *Config) map[string]bool {
+	dirs := make(map[string]bool)
+	for _, list := range [][]string{defaultHiddenDirs, config.HiddenDirs} {
+		for _, name := range list {
+			dirs[name] = true
+		}
+	}
+	return dirs
+}
+
+// isHidden reports whether the base of a slash separated name is hidden and not one of the directories walked anyway
+func (s *scanner) isHidden(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(base, ".") && base != "." && base != ".." && !s.hiddenDirs[base]
+}
+
+// depth returns the number of directories between the root and a slash separated name, plus one
+func depth(name string) int {
+	if name == "." {
+		return 0
+	}
+	return strings.Count(name, "/") + 1
+}
+
+// outOfBounds reports whether the walk does not enter the directory name, as it is as deep as the walk goes,
+// hidden or on another filesystem than the root
+func (s *scanner) outOfBounds(name string) (bool, error) {
+	if name == "." {
+		return false, nil
+	}
+	if s.maxDepth > 0 && depth(name) >= s.maxDepth { // its files would be deeper
+		return true, nil
+	}
+	if !s.hidden && s.isHidden(name) {
+		return true, nil
+	}
+
+	if s.oneFileSystem && s.rootDevice != nil {
+		info, err := fs.Stat(s.FS, name)
+		if err != nil {
+			return false, err
+		}
+		if dev, ok := device(info); ok && dev != *s.rootDevice { // a mount point
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// outOfBoundsFile reports whether a file of a tree or archive is below a directory the walk would not enter
+func (s *scanner) outOfBoundsFile(name string) bool {
+	if s.maxDepth > 0 && depth(name) > s.maxDepth {
+		return true
+	}
+	if !s.hidden {
+		for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if s.isHidden(dir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tooLarge reports whether the file name is larger than the limit, recording it as skipped if it is
+func (s *scanner) tooLarge(name string) (bool, error) {
+	if s.maxFileSize <= 0 {
+		return false, nil
+	}
+	info, err := fs.Stat(s.FS, name)
+	if err != nil {
+		return false, err
+	}
+	return s.overSizeLimit(name, info.Size()), nil
+}
+
+// overSizeLimit reports whether a file of size bytes is larger than the limit, recording it as skipped if it
+// is. Blobs and archive members are checked with the size they are listed with, before they are read.
+func (s *scanner) overSizeLimit(name string, size int64) bool {
+	if s.maxFileSize <= 0 || size <= s.maxFileSize {
+		return false
+	}
+	s.TooLarge = append(s.TooLarge, name)
+	return true
+}
@@ -0,0 +1,100 @@
+// loc - line splitting and line ending styles
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// Line ending styles of a file
+const (
+	LineEndingsLF    = "lf"    // Unix, \n
+	LineEndingsCRLF  = "crlf"  // Windows, \r\n
+	LineEndingsCR    = "cr"    // Classic Mac OS, a lone \r
+	LineEndingsMixed = "mixed" // More than one of the above
+)
+
+// lineEndings is the set of line endings seen in a file
+type lineEndings uint8
+
+const (
+	endingLF lineEndings = 1 << iota
+	endingCRLF
+	endingCR
+)
+
+// style returns the line ending style of the set, empty when no line was ended
+func (e lineEndings) style() string {
+	switch e {
+	case 0:
+		return ""
+	case endingLF:
+		return LineEndingsLF
+	case endingCRLF:
+		return LineEndingsCRLF
+	case endingCR:
+		return LineEndingsCR
+	default:
+		return LineEndingsMixed
+	}
+}
+
+// splitLines returns a split function for bufio.Scanner that ends lines at \n, \r\n and a lone \r, unlike
+// bufio.ScanLines which only knows \n, and adds the line endings it sees to endings. The line ending is
+// not part of the line.
+func splitLines(endings *lineEndings) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+
+		i := bytes.IndexAny(data, "\r\n")
+		switch {
+		case i < 0:
+			if atEOF { // the last line has no line ending
+				return len(data), data, nil
+			}
+			return 0, nil, nil // read more
+		case data[i] == '\n':
+			*endings |= endingLF
+			return i + 1, data[:i], nil
+		case i+1 < len(data) && data[i+1] == '\n':
+			*endings |= endingCRLF
+			return i + 2, data[:i], nil
+		case i+1 < len(data) || atEOF:
+			*endings |= endingCR
+			return i + 1, data[:i], nil
+		default:
+			return 0, nil, nil // a \r at the end of data, the next read tells whether a \n follows
+		}
+	}
+}
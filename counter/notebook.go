@@ -0,0 +1,168 @@
+// loc - counting of Jupyter notebooks
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// notebookLanguage is the language of Jupyter notebooks in the config. Their cells are counted as the
+// language of the notebook's kernel, or as notebookLanguage when it is not configured.
+const notebookLanguage = "jupyter"
+
+// proseRegexps classify every line of a markdown cell as a comment, or a blank line
+var proseRegexps = []*regexp.Regexp{regexp.MustCompile(``)}
+
+// notebook is the part of a Jupyter notebook that is counted, outputs are left out
+type notebook struct {
+	Metadata struct {
+		Kernelspec struct {
+			Language string `json:"language"`
+		} `json:"kernelspec"`
+		LanguageInfo struct {
+			Name          string `json:"name"`
+			FileExtension string `json:"file_extension"`
+		} `json:"language_info"`
+	} `json:"metadata"`
+	Cells []notebookCell `json:"cells"`
+}
+
+// notebookCell is a cell of a notebook
+type notebookCell struct {
+	CellType string         `json:"cell_type"` // code, markdown or raw
+	Source   notebookSource `json:"source"`
+}
+
+// notebookSource is the source of a cell, stored as a string or as a list of lines
+type notebookSource string
+
+// UnmarshalJSON implements json.Unmarshaler for notebookSource
+func (s *notebookSource) UnmarshalJSON(data []byte) error {
+	var lines []string
+	if err := json.Unmarshal(data, &lines); err == nil {
+		*s = notebookSource(strings.Join(lines, "")) // every line but the last ends with a line break
+		return nil
+	}
+
+	var source string
+	if err := json.Unmarshal(data, &source); err != nil {
+		return err
+	}
+	*s = notebookSource(source)
+	return nil
+}
+
+// kernelLanguage returns the configured language of the kernel of a notebook, found by the file extension
+// or the name of the language
+func (s *scanner) kernelLanguage(nb *notebook) string {
+	info := nb.Metadata.LanguageInfo
+	if info.FileExtension != "" {
+		if language := s.Config.DetectLanguage("notebook" + info.FileExtension); language != "" && language != notebookLanguage {
+			return language
+		}
+	}
+	for _, name := range []string{nb.Metadata.Kernelspec.Language, info.Name} {
+		name = strings.ToLower(name)
+		if _, ok := s.Config.Languages[name]; ok && name != "" {
+			return name
+		}
+	}
+	return notebookLanguage
+}
+
+// errInvalidNotebook is returned for a notebook that is not JSON, such as a Git LFS pointer or a notebook
+// with merge conflict markers
+var errInvalidNotebook = errors.New("invalid notebook")
+
+// isInvalidNotebook reports whether err from decoding a notebook is about its contents rather than reading it
+func isInvalidNotebook(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// skipInvalidNotebook records the file name as an invalid notebook, it is not counted
+func (s *scanner) skipInvalidNotebook(name string) {
+	s.InvalidNotebooks = append(s.InvalidNotebooks, name)
+}
+
+// countNotebook counts the cells of a notebook read from r, returning the language they are counted as.
+// Code cells are counted as the language of the kernel, the lines of markdown cells as comments. Raw
+// cells and outputs are not counted.
+func (s *scanner) countNotebook(r io.Reader) (string, Counts, error) {
+	var counts Counts
+	language, err := s.classifyNotebook(r, func(line string, kind lineKind) {
+		counts.addLine(kind)
+	})
+	if err != nil {
+		return "", Counts{}, err
+	}
+	return language, counts, nil
+}
+
+// classifyNotebook reads a notebook from r and calls fn with every line of its code and markdown cells and its
+// classification, as countNotebook counts them. It returns the language the lines are counted as.
+func (s *scanner) classifyNotebook(r io.Reader, fn func(line string, kind lineKind)) (string, error) {
+	var nb notebook
+	if err := json.NewDecoder(r).Decode(&nb); isInvalidNotebook(err) {
+		return "", fmt.Errorf("%w: %v", errInvalidNotebook, err)
+	} else if err != nil {
+		return "", err
+	}
+
+	language := s.kernelLanguage(&nb)
+	skipRegexps, err := s.languageSkipRegexps(language)
+	if err != nil {
+		return "", err
+	}
+
+	for _, cell := range nb.Cells {
+		cellRegexps := skipRegexps
+		switch cell.CellType {
+		case "code":
+		case "markdown":
+			cellRegexps = proseRegexps
+		default:
+			continue
+		}
+
+		if _, err := classifyLines(strings.NewReader(string(cell.Source)), cellRegexps, fn); err != nil {
+			return "", err
+		}
+	}
+
+	return language, nil
+}
@@ -0,0 +1,105 @@
+// loc - largest files and outliers
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Top returns the n files with the most lines of code, largest first. Files with equal code are sorted by path.
+func Top(files []FileCounts, n int) []FileCounts {
+	top := slices.Clone(files)
+	slices.SortStableFunc(top, func(a, b FileCounts) int {
+		return cmp.Or(cmp.Compare(b.Code, a.Code), strings.Compare(a.Path, b.Path))
+	})
+	if n >= 0 && n < len(top) {
+		top = top[:n]
+	}
+	return top
+}
+
+// OutlierOptions set what makes a file stand out
+type OutlierOptions struct {
+	MaxLines     int     // Files with more lines of code are outliers; 0 disables the check
+	CommentRatio float64 // Files whose comment density is below this fraction of their language's are outliers; 0 disables the check
+	MinLines     int     // Files with fewer lines of code are too small to judge their comment density
+}
+
+// DefaultOutlierOptions flag files over 1000 lines of code and files of 100 lines or more with less than a
+// quarter of the comment density of their language
+var DefaultOutlierOptions = OutlierOptions{MaxLines: 1000, CommentRatio: 0.25, MinLines: 100}
+
+// Outlier is a file that stands out, with the reasons why
+type Outlier struct {
+	FileCounts
+	Reasons []string `json:"reasons"`
+}
+
+// commentDensity is the share of comment lines among code and comment lines
+func commentDensity(c Counts) float64 {
+	if c.Code+c.Comment == 0 {
+		return 0
+	}
+	return float64(c.Comment) / float64(c.Code+c.Comment)
+}
+
+// Outliers returns the files that are larger than the line limit, have unusually few comments for their
+// language or are generated, in the order of files. languages holds the lines per language the comment
+// density of a file is compared with, usually Report.Languages.
+func Outliers(files []FileCounts, languages map[string]Counts, opts OutlierOptions) []Outlier {
+	var outliers []Outlier
+	for _, file := range files {
+		var reasons []string
+
+		if opts.MaxLines > 0 && file.Code > opts.MaxLines {
+			reasons = append(reasons, fmt.Sprintf("%d lines of code, over the limit of %d", file.Code, opts.MaxLines))
+		}
+
+		if opts.CommentRatio > 0 && file.Code >= opts.MinLines {
+			density, languageDensity := commentDensity(file.Counts), commentDensity(languages[file.Language])
+			if density < languageDensity*opts.CommentRatio {
+				reasons = append(reasons, fmt.Sprintf("%.1f%% comments, %s averages %.1f%%", density*100, file.Language, languageDensity*100))
+			}
+		}
+
+		if file.Generated > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d generated lines", file.Generated))
+		}
+
+		if len(reasons) > 0 {
+			outliers = append(outliers, Outlier{FileCounts: file, Reasons: reasons})
+		}
+	}
+	return outliers
+}
@@ -0,0 +1,216 @@
+// loc - line budgets checked after a count
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PolicyFile is the name of the policy file looked for in a counted directory
+const PolicyFile = ".loc-policy.json"
+
+// Budget limits the lines of code of a language, a directory or the whole count
+type Budget struct {
+	MaxLines  int      `json:"max_lines"`  // Most lines of code; 0 for no limit
+	MaxGrowth *float64 `json:"max_growth"` // Most growth of the lines of code since the baseline in percent; no limit when missing
+}
+
+// Policy declares the budgets a count has to stay within
+type Policy struct {
+	MaxFileLines int               `json:"max_file_lines"` // Most lines of code in a single file; 0 for no limit
+	Total        Budget            `json:"total"`          // Budget of all counted files
+	Languages    map[string]Budget `json:"languages"`      // Budgets per language
+	Dirs         map[string]Budget `json:"dirs"`           // Budgets per slash separated directory relative to the counted root
+	Baseline     string            `json:"baseline"`       // Report growth is measured against, relative to the policy file
+}
+
+// Violation is a budget a count exceeds
+type Violation struct {
+	Path    string `json:"path"`    // The file, directory, language or "total" over budget
+	Message string `json:"message"` // What the limit is and by how much it is exceeded
+}
+
+// LoadPolicy reads a policy file. Unknown fields are an error, so a misspelt limit is not silently ignored.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy Policy
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("invalid policy '%s': %v", file, err)
+	}
+
+	// the baseline lives next to the policy
+	if policy.Baseline != "" && !filepath.IsAbs(policy.Baseline) {
+		policy.Baseline = filepath.Join(filepath.Dir(file), policy.Baseline)
+	}
+
+	return &policy, nil
+}
+
+// LoadReport reads a report written as JSON, e.g. a baseline
+func LoadReport(file string) (*Report, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("invalid report '%s': %v", file, err)
+	}
+	return &report, nil
+}
+
+// NeedsBaseline reports whether the policy limits growth, which needs the baseline to be loaded
+func (p *Policy) NeedsBaseline() bool {
+	if p.Total.MaxGrowth != nil {
+		return true
+	}
+	for _, budgets := range []map[string]Budget{p.Languages, p.Dirs} {
+		for _, budget := range budgets {
+			if budget.MaxGrowth != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dirCode returns the lines of code of the files below the slash separated directory dir
+func dirCode(files []FileCounts, dir string) int {
+	code := 0
+	for _, file := range files {
+		if dir == "." || strings.HasPrefix(file.Path, dir+"/") {
+			code += file.Code
+		}
+	}
+	return code
+}
+
+// check checks the lines of code of name against a budget, and against the lines of code in the baseline
+// when base is not negative
+func (b Budget) check(name string, code, base int) []Violation {
+	var violations []Violation
+
+	if b.MaxLines > 0 && code > b.MaxLines {
+		violations = append(violations, Violation{
+			Path:    name,
+			Message: fmt.Sprintf("%d lines of code, over the limit of %d", code, b.MaxLines),
+		})
+	}
+
+	// growth is only measured for what the baseline already had
+	if b.MaxGrowth != nil && base > 0 {
+		growth := float64(code-base) / float64(base) * 100
+		if growth > *b.MaxGrowth {
+			violations = append(violations, Violation{
+				Path:    name,
+				Message: fmt.Sprintf("grew %.1f%% from %d to %d lines of code, over the limit of %g%%", growth, base, code, *b.MaxGrowth),
+			})
+		}
+	}
+
+	return violations
+}
+
+// Check returns the budgets of the policy report exceeds, files first, then languages, directories and the
+// total. Directory budgets need the counts of every file, see Options.Files. baseline may be nil when the
+// policy does not limit growth.
+func (p *Policy) Check(report *Report, baseline *Report) ([]Violation, error) {
+	if p.NeedsBaseline() && baseline == nil {
+		return nil, fmt.Errorf("the policy limits growth but there is no baseline")
+	}
+
+	var violations []Violation
+
+	if p.MaxFileLines > 0 {
+		for _, file := range report.Files {
+			if file.Code > p.MaxFileLines {
+				violations = append(violations, Violation{
+					Path:    file.Path,
+					Message: fmt.Sprintf("%d lines of code, over the limit of %d per file", file.Code, p.MaxFileLines),
+				})
+			}
+		}
+	}
+
+	// base returns the lines of code in the baseline, -1 without one
+	base := func(code func(r *Report) int) int {
+		if baseline == nil {
+			return -1
+		}
+		return code(baseline)
+	}
+
+	for _, language := range sortedKeys(p.Languages) {
+		violations = append(violations, p.Languages[language].check(language, report.Languages[language].Code, base(func(r *Report) int {
+			return r.Languages[language].Code
+		}))...)
+	}
+
+	for _, name := range sortedKeys(p.Dirs) {
+		budget, dir := p.Dirs[name], path.Clean(name) // "src/" is src
+		if budget.MaxGrowth != nil && len(baseline.Files) == 0 {
+			return nil, fmt.Errorf("the baseline has no counts per file to measure the growth of '%s'", name)
+		}
+		violations = append(violations, budget.check(dir, dirCode(report.Files, dir), base(func(r *Report) int {
+			return dirCode(r.Files, dir)
+		}))...)
+	}
+
+	violations = append(violations, p.Total.check("total", report.Total.Code, base(func(r *Report) int {
+		return r.Total.Code
+	}))...)
+
+	return violations, nil
+}
+
+// sortedKeys returns the keys of a map of budgets in order
+func sortedKeys(budgets map[string]Budget) []string {
+	keys := make([]string, 0, len(budgets))
+	for key := range budgets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,108 @@
+// loc - progress events emitted while scanning
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"io"
+	"path"
+	"path/filepath"
+)
+
+// Progress is a snapshot of a running count, passed to Options.Progress after every file
+type Progress struct {
+	FilesVisited int    // Files walked past that were not excluded
+	FilesCounted int    // Files in a known language whose lines were counted
+	FilesTotal   int    // Files the scan will visit, 0 when there is no file list up front
+	BytesRead    int64  // Bytes read from counted files
+	Lines        int    // Code, comment and blank lines counted so far
+	Dir          string // Slash separated directory of the last file visited
+}
+
+// visit records that the file with the slash separated name is about to be scanned
+func (s *scanner) visit(name string) {
+	s.progress.FilesVisited++
+	s.progress.Dir = path.Dir(name)
+}
+
+// counted records a counted file of n bytes
+func (s *scanner) counted(n int64, counts Counts) {
+	s.progress.FilesCounted++
+	s.progress.BytesRead += n
+	s.progress.Lines += counts.Code + counts.Comment + counts.Blank
+}
+
+// emit passes the current progress to the callback, if there is one
+func (s *scanner) emit() {
+	if s.onProgress != nil {
+		s.onProgress(s.progress)
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements io.Reader
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// listed reports whether a file listed up front, as a tree entry, tracked file or archive member, is visited
+// by the scan: it is not excluded, below a directory the walk does not enter or vendored. Nothing is recorded.
+func (s *scanner) listed(name string) bool {
+	if s.shouldExcludeTreePath(s.path(name)) || s.outOfBoundsFile(name) {
+		return false
+	}
+	_, vendored := s.vendoredPath(name)
+	return !vendored
+}
+
+// gitFileCount returns the number of files in a set of git files, which also holds their parent directories,
+// that the scan visits
+func (s *scanner) gitFileCount(files map[string]bool) int {
+	dirs := make(map[string]bool)
+	for name := range files {
+		if dir := filepath.Dir(name); dir != "." {
+			dirs[dir] = true
+		}
+	}
+	count := 0
+	for name := range files {
+		if !dirs[name] && s.listed(filepath.ToSlash(name)) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,96 @@
+// loc - per-directory rollup of file counts
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// Dir is a directory in a rollup of counted files, holding the lines of every file below it
+type Dir struct {
+	Path  string `json:"path"`  // Slash separated path relative to the counted root, "." for the root itself
+	Files int    `json:"files"` // Files counted below the directory
+	Counts
+	Dirs []*Dir `json:"dirs,omitempty"` // Subdirectories holding counted files, down to the depth of the rollup
+}
+
+// Rollup aggregates the lines of files into a tree of the directories holding them, like du. Directories
+// deeper than depth are folded into their ancestor at that depth, a depth of 0 keeps every level.
+// Subdirectories are sorted by path.
+func Rollup(files []FileCounts, depth int) *Dir {
+	root := &Dir{Path: "."}
+	dirs := map[string]*Dir{".": root}
+
+	for _, file := range files {
+		root.Files++
+		root.add(file.Counts)
+
+		dir := path.Dir(file.Path)
+		if dir == "." { // directly in the root
+			continue
+		}
+		parts := strings.Split(dir, "/")
+		if depth > 0 && len(parts) > depth {
+			parts = parts[:depth]
+		}
+
+		// add the file to every directory leading up to it
+		parent := root
+		for i := range parts {
+			name := strings.Join(parts[:i+1], "/")
+			d, ok := dirs[name]
+			if !ok {
+				d = &Dir{Path: name}
+				dirs[name] = d
+				parent.Dirs = append(parent.Dirs, d)
+			}
+			d.Files++
+			d.add(file.Counts)
+			parent = d
+		}
+	}
+
+	root.Sort(func(a, b *Dir) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return root
+}
+
+// Sort sorts the subdirectories at every level of the tree with cmp, which returns a negative number
+// when a comes before b, a positive number when it comes after and 0 to keep their order
+func (d *Dir) Sort(cmp func(a, b *Dir) int) {
+	slices.SortStableFunc(d.Dirs, cmp)
+	for _, sub := range d.Dirs {
+		sub.Sort(cmp)
+	}
+}
@@ -0,0 +1,476 @@
+// loc - walk a directory and count lines of code
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// scanner walks a directory, git tree or archive and counts the lines of the files it finds
+type scanner struct {
+	Report                           // The lines counted so far
+	Config          *Config          // The Loc configuration
+	FS              fs.FS            // The filesystem to scan
+	Directory       string           // The directory FS is rooted at, or the git repository or archive to scan; empty when FS is not on disk
+	ExcludePatterns []*regexp.Regexp // Compiled regex patterns for file exclusion
+	GitFiles        map[string]bool  // Files tracked by git and their parent directories, relative to Directory; nil counts every file
+
+	start       string                      // The name in FS the walk starts from, the whole filesystem when empty
+	skipRegexps map[string][]*regexp.Regexp // Compiled skip patterns per language
+	progress    Progress                    // Files and lines seen so far
+	onProgress  func(Progress)              // Called after every file, may be nil
+	cache       *fileCache                  // Counts of unchanged files from the previous scan, nil when not caching
+	files       bool                        // Whether the counts of every file are kept in Report.Files
+
+	countGenerated    bool                         // Count generated files like any other
+	generatedPatterns map[string]generatedPatterns // Compiled generated file patterns per language
+	embedded          map[string][]embeddedRegion  // Compiled embedded regions per language
+	vendoredRegexps   []*regexp.Regexp             // Compiled vendored paths, nil when vendored code is counted
+	followSymlinks    bool                         // Walk linked directories
+	visited           map[fileID]bool              // Files and directories seen in this walk, when following symlinks
+	maxDepth          int                          // Directories the walk goes down at most, 0 for no limit
+	maxFileSize       int64                        // Bytes of the largest file counted, 0 for no limit
+	hidden            bool                         // Walk every hidden directory
+	hiddenDirs        map[string]bool              // Names of the hidden directories walked anyway
+	oneFileSystem     bool                         // Stay on the filesystem of the root
+	rootDevice        *uint64                      // Device of the root, when staying on its filesystem
+}
+
+// compileExcludePatterns compiles the exclude patterns into regular expressions
+func compileExcludePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiledPatterns []*regexp.Regexp
+
+	for _, pattern := range patterns {
+		// Compile the regex pattern directly (no glob conversion)
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern '%s': %v", pattern, err)
+		}
+
+		compiledPatterns = append(compiledPatterns, compiled)
+	}
+
+	return compiledPatterns, nil
+}
+
+// shouldExcludeFile checks if a file or directory should be excluded based on patterns
+func (s *scanner) shouldExcludeFile(path string) bool {
+	// Get the base name and relative path for pattern matching
+	baseName := filepath.Base(path)
+	relPath := strings.TrimPrefix(path, s.Directory)
+	relPath = strings.TrimPrefix(relPath, string(os.PathSeparator))
+
+	// Check against all exclusion patterns
+	for _, pattern := range s.ExcludePatterns {
+		// Check against full relative path
+		if pattern.MatchString(relPath) {
+			return true
+		}
+		// Check against base name
+		if pattern.MatchString(baseName) {
+			return true
+		}
+		// Check against full path
+		if pattern.MatchString(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// shouldExcludeTreePath checks if a file or any directory leading up to it should be excluded,
+// matching what the directory walk would skip for files that are not read from disk
+func (s *scanner) shouldExcludeTreePath(path string) bool {
+	for p := path; p != s.Directory && p != filepath.Dir(p); p = filepath.Dir(p) {
+		if s.shouldExcludeFile(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGitFile checks if a file or directory is tracked by git, always true when not in git tracked mode
+func (s *scanner) isGitFile(name string) bool {
+	if s.GitFiles == nil || name == "." { // the root itself is always walked
+		return true
+	}
+
+	return s.GitFiles[filepath.FromSlash(name)]
+}
+
+// path returns the path exclude patterns and language detection see for a name in FS
+func (s *scanner) path(name string) string {
+	if s.Directory == "" { // not on disk, names are matched as they are
+		return filepath.FromSlash(name)
+	}
+	return filepath.Join(s.Directory, filepath.FromSlash(name))
+}
+
+// walkAll walks FS and calls fn with the slash separated name of every file and directory that is not excluded.
+// Vendored files and directories are skipped, and passed to vendored instead when it is not nil.
+func (s *scanner) walkAll(ctx context.Context, fn, vendored func(name string, entry fs.DirEntry) error) error {
+	start := s.start
+	if start == "" {
+		start = "."
+	}
+
+	// every walk finds the links again
+	s.BrokenLinks = nil
+	if s.followSymlinks {
+		s.visited = make(map[fileID]bool)
+	}
+	if s.oneFileSystem {
+		info, err := fs.Stat(s.FS, ".")
+		if err != nil {
+			return err
+		}
+		if dev, ok := device(info); ok { // a filesystem that is not on disk has no mount points
+			s.rootDevice = &dev
+		}
+	}
+
+	return s.walkDir(ctx, start, fn, vendored)
+}
+
+// walkDir walks FS from root for walkAll, walking linked directories when following symlinks
+func (s *scanner) walkDir(ctx context.Context, root string, fn, vendored func(name string, entry fs.DirEntry) error) error {
+	// Walk the filesystem
+	return fs.WalkDir(s.FS, root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil { // if there is an error, return the error
+			return err
+		}
+
+		// Stop when the caller gives up
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Check if this file or directory is known to git
+		if !s.isGitFile(name) {
+			if entry.IsDir() {
+				return fs.SkipDir // nothing tracked below this directory
+			}
+			return nil // Skip untracked file
+		}
+
+		// Check if this file or directory should be excluded
+		if s.shouldExcludeFile(s.path(name)) {
+			if entry.IsDir() {
+				return fs.SkipDir // Skip entire directory
+			}
+			return nil // Skip this file
+		}
+
+		// Stay within the limits of the walk
+		if entry.IsDir() {
+			skip, err := s.outOfBounds(name)
+			if err != nil {
+				return err
+			}
+			if skip {
+				return fs.SkipDir
+			}
+		}
+
+		// Skip vendored code, which is not ours to count
+		if s.isVendored(name) {
+			if vendored != nil {
+				if err := vendored(name, entry); err != nil {
+					return err
+				}
+			}
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		// Links are counted as what they point to, a dangling link is no reason to give up the count
+		if entry.Type()&fs.ModeSymlink != 0 {
+			info, err := fs.Stat(s.FS, name)
+			if err != nil {
+				s.BrokenLinks = append(s.BrokenLinks, name)
+				return nil
+			}
+			if info.IsDir() {
+				if !s.followSymlinks {
+					return nil // linked directories are only walked when asked to
+				}
+				return s.walkDir(ctx, name, fn, vendored) // its root is checked for cycles below
+			}
+			entry = fs.FileInfoToDirEntry(info)
+		}
+
+		// Files and directories reached through a link may be reached again, directly or through another
+		if s.followSymlinks {
+			info, err := fs.Stat(s.FS, name)
+			if err != nil {
+				return err
+			}
+			if !s.firstVisit(info) {
+				if entry.IsDir() {
+					return fs.SkipDir // already walked, or a link back to a parent
+				}
+				return nil // already counted
+			}
+		}
+
+		return fn(name, entry)
+	})
+}
+
+// firstVisit reports whether the file or directory is visited for the first time in this walk. Files
+// without an identity, outside a filesystem on disk, cannot be linked to and are always visited.
+func (s *scanner) firstVisit(info fs.FileInfo) bool {
+	key, ok := fileKey(info)
+	if !ok {
+		return true
+	}
+	if s.visited[key] {
+		return false
+	}
+	s.visited[key] = true
+	return true
+}
+
+// walk walks FS and calls fn with the slash separated name of every file that is not excluded
+func (s *scanner) walk(ctx context.Context, fn func(name string) error) error {
+	return s.walkAll(ctx, func(name string, entry fs.DirEntry) error {
+		if entry.IsDir() { // directories are only walked through
+			return nil
+		}
+
+		s.visit(name)
+		if err := fn(name); err != nil {
+			return err
+		}
+		s.emit()
+		return nil
+	}, func(name string, _ fs.DirEntry) error {
+		s.addVendored(name)
+		return nil
+	})
+}
+
+// scan walks FS and counts the lines of code
+func (s *scanner) scan(ctx context.Context) error {
+	return s.walk(ctx, func(name string) error {
+		language := s.Config.DetectLanguage(s.path(name))
+		if language == "" { // not a file we count
+			return nil
+		}
+
+		if skip, err := s.tooLarge(name); err != nil || skip { // checked before anything is read
+			return err
+		}
+
+		if s.cache != nil { // unchanged files are not read again
+			return s.countCached(name, language)
+		}
+
+		// we need to open the file
+		file, err := s.FS.Open(name)
+		if err != nil {
+			return err
+		}
+		defer func(file fs.File) {
+			_ = file.Close()
+		}(file) // defer the closure of the file
+
+		_, _, err = s.count(name, language, file)
+		return err
+	})
+}
+
+// count counts the lines of the file name read from r as the given language, adds them to the report and
+// returns them. Notebooks are counted as the language of their kernel. It reports false for a binary file
+// or an invalid notebook, which is listed in the report instead of counted.
+func (s *scanner) count(name, language string, r io.Reader) (FileCounts, bool, error) {
+	reader := &countingReader{r: r}
+	file := FileCounts{Path: name, Language: language}
+	if language == notebookLanguage {
+		var err error
+		file.Language, file.Counts, err = s.countNotebook(reader)
+		if errors.Is(err, errInvalidNotebook) { // one bad notebook is no reason to give up the count
+			s.skipInvalidNotebook(name)
+			return FileCounts{}, false, nil
+		} else if err != nil {
+			return FileCounts{}, false, fmt.Errorf("%s: %v", name, err)
+		}
+		s.record(file)
+		s.counted(reader.n, file.Counts)
+		return file, true, nil
+	}
+
+	body, header, binary := decode(reader, s.Config.Languages[language].Encoding)
+	if binary { // a data file with the extension of a language, only the first block is read
+		s.skipBinary(name)
+		return FileCounts{}, false, nil
+	}
+	generated, err := s.isGenerated(name, language, header)
+	if err != nil {
+		return FileCounts{}, false, err
+	}
+
+	file.Counts, file.Embedded, file.LineEndings, err = s.countText(language, body)
+	if err != nil {
+		return FileCounts{}, false, err
+	}
+	if generated {
+		file = file.asGenerated()
+	}
+
+	s.record(file)
+	s.counted(reader.n, file.Counts)
+	return file, true, nil
+}
+
+// record adds the counts of a file to the report, the lines of embedded languages to their language
+func (s *scanner) record(file FileCounts) {
+	host := file.Counts
+	for language, counts := range file.Embedded {
+		s.add(language, counts)
+		host = host.minus(counts)
+	}
+	s.add(file.Language, host)
+	if file.LineEndings == LineEndingsMixed {
+		s.MixedLineEndings = append(s.MixedLineEndings, file.Path)
+	}
+	if s.files {
+		s.Files = append(s.Files, file)
+	}
+}
+
+// languageSkipRegexps returns the compiled skip patterns of a language, compiling them on first use
+func (s *scanner) languageSkipRegexps(language string) ([]*regexp.Regexp, error) {
+	if skipRegexps, ok := s.skipRegexps[language]; ok {
+		return skipRegexps, nil
+	}
+
+	skipRegexps, err := compileSkipPatterns(s.Config.Languages[language].SkipPatterns)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.skipRegexps == nil {
+		s.skipRegexps = make(map[string][]*regexp.Regexp)
+	}
+	s.skipRegexps[language] = skipRegexps
+	return skipRegexps, nil
+}
+
+// lineKind is what a line of source is classified as
+type lineKind int
+
+const (
+	lineCode    lineKind = iota // A line that is counted
+	lineComment                 // A skipped line holding a comment or other text
+	lineBlank                   // A skipped line holding only whitespace
+)
+
+// compileSkipPatterns compiles the skip patterns of a language into regular expressions
+func compileSkipPatterns(skipPatterns []string) ([]*regexp.Regexp, error) {
+	// create a slice of regular expressions for the skip patterns
+	skipRegexps := make([]*regexp.Regexp, len(skipPatterns))
+	for i, pattern := range skipPatterns {
+		compiled, err := regexp.Compile(pattern) // compile the regular expression
+		if err != nil {
+			return nil, fmt.Errorf("invalid skip pattern '%s': %v", pattern, err)
+		}
+		skipRegexps[i] = compiled
+	}
+	return skipRegexps, nil
+}
+
+// classifyLine classifies a line; lines matching a skip pattern are blank or comment lines, all others are code
+func classifyLine(line string, skipRegexps []*regexp.Regexp) lineKind {
+	for _, re := range skipRegexps {
+		if re.MatchString(line) { // if the line matches the regular expression we skip it
+			if strings.TrimSpace(line) == "" {
+				return lineBlank
+			}
+			return lineComment
+		}
+	}
+	return lineCode
+}
+
+// classifyLines reads the lines from r and calls fn with every line and its classification. It returns the
+// line endings that were seen.
+func classifyLines(r io.Reader, skipRegexps []*regexp.Regexp, fn func(line string, kind lineKind)) (lineEndings, error) {
+	var endings lineEndings
+	scanner := bufio.NewScanner(r) // create a scanner for the contents
+	scanner.Split(splitLines(&endings))
+
+	for scanner.Scan() { // iterate over the lines of the file
+		line := scanner.Text() // get the line of the file
+		fn(line, classifyLine(line, skipRegexps))
+	}
+
+	// check for scanner errors
+	return endings, scanner.Err()
+}
+
+// addLine counts a line of the given classification
+func (c *Counts) addLine(kind lineKind) {
+	switch kind {
+	case lineCode: // if we are not skipping the line we increment the lines of code
+		c.Code++
+	case lineComment:
+		c.Comment++
+	case lineBlank:
+		c.Blank++
+	}
+}
+
+// countReader counts the lines read from r by classification, and returns the line ending style
+func countReader(r io.Reader, skipRegexps []*regexp.Regexp) (Counts, string, error) {
+	var counts Counts // lines in the file
+
+	endings, err := classifyLines(r, skipRegexps, func(line string, kind lineKind) {
+		counts.addLine(kind)
+	})
+	if err != nil {
+		return Counts{}, "", err
+	}
+
+	return counts, endings.style(), nil
+}
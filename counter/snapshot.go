@@ -0,0 +1,143 @@
+// loc - snapshots of a count and comparisons against them
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format written by loc
+const SnapshotVersion = 1
+
+// Snapshot is a report saved with the counts of every file, to compare later counts with.
+// LoadReport reads a snapshot back.
+type Snapshot struct {
+	Version int       `json:"version"` // The version of the format, SnapshotVersion
+	Created time.Time `json:"created"` // When the count was made
+	Root    string    `json:"root"`    // The directory that was counted
+	Report
+}
+
+// Change is how the lines of a language, a directory or the whole count changed between two reports
+type Change struct {
+	Before Counts `json:"before"` // The lines in the earlier report
+	After  Counts `json:"after"`  // The lines in the later report
+}
+
+// DirChange is how the lines below a directory changed
+type DirChange struct {
+	Path string `json:"path"` // Slash separated path relative to the counted root, "." for the root itself
+	Change
+}
+
+// Comparison is the change between two reports per language and per directory
+type Comparison struct {
+	Total     Change            `json:"total"`     // All counted files
+	Languages map[string]Change `json:"languages"` // Per language in either report
+	Dirs      []DirChange       `json:"dirs"`      // Per directory in either report down to the depth of the comparison, by path
+}
+
+// dirCounts flattens the rollup of files into the lines per directory
+func dirCounts(files []FileCounts, depth int) map[string]Counts {
+	dirs := make(map[string]Counts)
+	var walk func(d *Dir)
+	walk = func(d *Dir) {
+		dirs[d.Path] = d.Counts
+		for _, sub := range d.Dirs {
+			walk(sub)
+		}
+	}
+	walk(Rollup(files, depth))
+	return dirs
+}
+
+// Compare compares a report with an earlier one. Directories are compared down to depth, 0 for every level,
+// which needs the counts of every file in both reports.
+func Compare(before, after *Report, depth int) *Comparison {
+	comparison := &Comparison{
+		Total:     Change{Before: before.Total, After: after.Total},
+		Languages: make(map[string]Change),
+	}
+
+	for language, counts := range before.Languages {
+		comparison.Languages[language] = Change{Before: counts}
+	}
+	for language, counts := range after.Languages {
+		change := comparison.Languages[language]
+		change.After = counts
+		comparison.Languages[language] = change
+	}
+
+	beforeDirs, afterDirs := dirCounts(before.Files, depth), dirCounts(after.Files, depth)
+	paths := make(map[string]bool)
+	for dir := range beforeDirs {
+		paths[dir] = true
+	}
+	for dir := range afterDirs {
+		paths[dir] = true
+	}
+	for dir := range paths {
+		comparison.Dirs = append(comparison.Dirs, DirChange{Path: dir, Change: Change{Before: beforeDirs[dir], After: afterDirs[dir]}})
+	}
+	sort.Slice(comparison.Dirs, func(i, j int) bool {
+		return comparison.Dirs[i].Path < comparison.Dirs[j].Path
+	})
+
+	return comparison
+}
+
+// Ratchet checks that a report did not get worse than an earlier one: the share of comment lines among
+// code and comment lines may not drop, and the legacy directories may not gain lines of code.
+func Ratchet(before, after *Report, legacyDirs []string) []Violation {
+	var violations []Violation
+
+	if beforeDensity, afterDensity := commentDensity(before.Total), commentDensity(after.Total); afterDensity < beforeDensity {
+		violations = append(violations, Violation{
+			Path:    "total",
+			Message: fmt.Sprintf("comment ratio dropped from %.1f%% to %.1f%%", beforeDensity*100, afterDensity*100),
+		})
+	}
+
+	for _, legacyDir := range legacyDirs {
+		dir := path.Clean(legacyDir)
+		if beforeCode, afterCode := dirCode(before.Files, dir), dirCode(after.Files, dir); afterCode > beforeCode {
+			violations = append(violations, Violation{
+				Path:    dir,
+				Message: fmt.Sprintf("legacy code grew from %d to %d lines", beforeCode, afterCode),
+			})
+		}
+	}
+
+	return violations
+}
@@ -0,0 +1,104 @@
+// loc - detection of vendored and third-party code
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"path"
+	"regexp"
+	"slices"
+)
+
+// defaultVendored match the slash separated paths of directories holding vendored or third-party code,
+// in the spirit of linguist's vendor.yml
+var defaultVendored = []string{
+	`(^|/)vendor$`,
+	`(^|/)third[_-]party$`,
+	`(^|/)node_modules$`,
+	`(^|/)bower_components$`,
+	`(^|/)jspm_packages$`,
+	`(^|/)\.venv$`,
+	`(^|/)Pods$`,
+	`(^|/)Carthage/(Build|Checkouts)$`,
+}
+
+// compileVendoredPatterns compiles the built-in vendored paths together with those of the config
+func compileVendoredPatterns(config *Config) ([]*regexp.Regexp, error) {
+	return compilePatterns("vendored", defaultVendored, config.Vendored)
+}
+
+// isVendored reports whether the slash separated name is vendored. Vendored code is counted like any
+// other when IncludeVendored is set.
+func (s *scanner) isVendored(name string) bool {
+	if s.vendoredRegexps == nil { // including vendored code
+		return false
+	}
+	for _, re := range s.vendoredRegexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// vendoredPath returns the vendored directory a file with the slash separated name is in, or the file
+// itself when it is vendored, for files that are not found by walking directories
+func (s *scanner) vendoredPath(name string) (string, bool) {
+	var dirs []string
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+
+	// the outermost vendored directory is the one that is skipped
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if s.isVendored(dirs[i]) {
+			return dirs[i], true
+		}
+	}
+	return name, s.isVendored(name)
+}
+
+// skipVendoredFile records the file with the slash separated name as skipped if it is vendored, for trees
+// and archives whose files are listed rather than walked
+func (s *scanner) skipVendoredFile(name string) bool {
+	vendored, ok := s.vendoredPath(name)
+	if ok {
+		s.addVendored(vendored)
+	}
+	return ok
+}
+
+// addVendored records the vendored directory or file name as skipped. Directories are not walked, so only
+// their paths are known.
+func (s *scanner) addVendored(name string) {
+	if !slices.Contains(s.Vendored, name) { // files of a tree or archive come one at a time
+		s.Vendored = append(s.Vendored, name)
+	}
+}
@@ -0,0 +1,183 @@
+// loc - recount a directory whenever files below it change
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"time"
+)
+
+// changeWatcher notices when the files a scanner counts change
+type changeWatcher interface {
+	watch(ctx context.Context, s *scanner) error // starts watching the files of s, before they are counted
+	wait(ctx context.Context, s *scanner) error  // returns once a file changed since watch
+	close() error
+}
+
+// fileStamp is what the poll watcher compares to notice a changed file
+type fileStamp struct {
+	Size    int64 // Size in bytes
+	ModTime int64 // Modification time in Unix nanoseconds
+}
+
+// pollWatcher notices changes by comparing the size and mtime of every file each interval
+type pollWatcher struct {
+	interval time.Duration        // Time between two checks
+	files    map[string]fileStamp // The files as they were when watching started
+}
+
+// snapshot records the size and mtime of every file s would count
+func (w *pollWatcher) snapshot(ctx context.Context, s *scanner) (map[string]fileStamp, error) {
+	files := make(map[string]fileStamp)
+	err := s.walkAll(ctx, func(name string, entry fs.DirEntry) error {
+		if entry.IsDir() || s.Config.DetectLanguage(s.path(name)) == "" {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil // removed while walking, the next check notices
+		}
+		files[name] = fileStamp{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+		return nil
+	}, nil)
+	return files, err
+}
+
+// watch implements changeWatcher
+func (w *pollWatcher) watch(ctx context.Context, s *scanner) error {
+	files, err := w.snapshot(ctx, s)
+	if err != nil {
+		return err
+	}
+	w.files = files
+	return nil
+}
+
+// wait implements changeWatcher
+func (w *pollWatcher) wait(ctx context.Context, s *scanner) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		files, err := w.snapshot(ctx, s)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // a directory was removed while walking it
+		} else if err != nil {
+			return err
+		}
+		if !maps.Equal(files, w.files) { // a file was added, removed or changed
+			return nil
+		}
+	}
+}
+
+// close implements changeWatcher
+func (w *pollWatcher) close() error {
+	return nil
+}
+
+// newMemoryCache returns a file cache that is kept in memory between the counts of a watch
+func newMemoryCache(hash bool) *fileCache {
+	return &fileCache{hash: hash, fresh: make(map[string]cacheEntry)}
+}
+
+// roll makes the entries of the last scan the entries the next scan looks up
+func (c *fileCache) roll() {
+	c.old.Files, c.fresh = c.fresh, make(map[string]cacheEntry)
+}
+
+// Watch counts the directory root like Count, then counts it again whenever a file below it changes,
+// calling fn with every report until ctx is done or fn returns an error. Changes are noticed through
+// inotify on Linux and by checking every file each interval elsewhere; excluded directories are not
+// watched and only changed files are read again. Files removed while counting start the count over.
+func Watch(ctx context.Context, root string, opts Options, interval time.Duration, fn func(*Report) error) error {
+	if opts.Rev != "" {
+		return fmt.Errorf("a revision does not change, count it with Count")
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", root)
+	}
+
+	watcher := newChangeWatcher(interval)
+	defer func(watcher changeWatcher) {
+		_ = watcher.close()
+	}(watcher)
+
+	cache := newMemoryCache(opts.CacheHash)
+	for {
+		// a new scanner for every count, the files tracked by git may have changed too
+		s, err := opts.newScanner(ctx, root)
+		if err != nil {
+			return err
+		}
+		if err := s.useDir(root); err != nil {
+			return err
+		}
+
+		// watch before counting, so changes made while counting are not missed
+		if err := watcher.watch(ctx, s); errors.Is(err, fs.ErrNotExist) {
+			continue // a directory was removed while walking it
+		} else if err != nil {
+			return err
+		}
+
+		s.cache = cache
+		if err := s.scan(ctx); errors.Is(err, fs.ErrNotExist) {
+			continue // removed between the walk and the count, still changing, so count again
+		} else if err != nil {
+			return err
+		}
+		cache.roll()
+
+		if err := fn(&s.Report); err != nil {
+			return err
+		}
+
+		if err := watcher.wait(ctx, s); err != nil {
+			return err
+		}
+	}
+}
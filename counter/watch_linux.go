@@ -0,0 +1,170 @@
+// loc - inotify change watcher
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package counter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"path"
+	"syscall"
+	"time"
+)
+
+// inotifyMask are the events that change what a directory holds
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+
+// inotifyWatcher watches every directory that is not excluded for changes through inotify. The descriptor is
+// read without blocking every interval, so changes arriving in a burst, e.g. a branch switch, cause one count.
+type inotifyWatcher struct {
+	fd       int            // The inotify instance
+	interval time.Duration  // Time between two reads of the descriptor
+	dirs     map[int]string // Slash separated directory names by watch descriptor
+	poll     *pollWatcher   // The fallback once inotify fails, e.g. when the watch limit is reached
+}
+
+// newChangeWatcher returns an inotify watcher, or a watcher checking for changes every interval when inotify is not available
+func newChangeWatcher(interval time.Duration) changeWatcher {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return &pollWatcher{interval: interval}
+	}
+	return &inotifyWatcher{fd: fd, interval: interval, dirs: make(map[int]string)}
+}
+
+// watch implements changeWatcher
+func (w *inotifyWatcher) watch(ctx context.Context, s *scanner) error {
+	if w.poll != nil {
+		return w.poll.watch(ctx, s)
+	}
+
+	// adding a watch twice returns the same descriptor, so directories created since the last count are added
+	err := s.walkAll(ctx, func(name string, entry fs.DirEntry) error {
+		if !entry.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, s.path(name), inotifyMask)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // removed while walking, its parent notices
+		} else if err != nil {
+			return err
+		}
+		w.dirs[wd] = name
+		return nil
+	}, nil)
+	if err != nil && ctx.Err() == nil && !errors.Is(err, fs.ErrNotExist) { // a removed directory is counted again
+		w.poll = &pollWatcher{interval: w.interval}
+		return w.poll.watch(ctx, s)
+	}
+	return err
+}
+
+// wait implements changeWatcher
+func (w *inotifyWatcher) wait(ctx context.Context, s *scanner) error {
+	if w.poll != nil {
+		return w.poll.wait(ctx, s)
+	}
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	buf := make([]byte, 64*1024)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		// drain every queued event before deciding
+		changed := false
+		for {
+			n, err := syscall.Read(w.fd, buf)
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				break
+			} else if err != nil { // n is -1 on errors, so check them first
+				return err
+			} else if n <= 0 {
+				break
+			}
+			if w.relevant(s, buf[:n]) {
+				changed = true
+			}
+		}
+		if changed {
+			return nil
+		}
+	}
+}
+
+// relevant reports whether a buffer of inotify events holds a change to a file s counts
+func (w *inotifyWatcher) relevant(s *scanner, buf []byte) bool {
+	relevant := false
+
+	// each event is a struct inotify_event: wd, mask, cookie and len followed by a NUL padded name
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		wd := int(int32(binary.NativeEndian.Uint32(buf[0:])))
+		mask := binary.NativeEndian.Uint32(buf[4:])
+		nameLen := int(binary.NativeEndian.Uint32(buf[12:]))
+		end := min(syscall.SizeofInotifyEvent+nameLen, len(buf))
+		name := string(bytes.TrimRight(buf[syscall.SizeofInotifyEvent:end], "\x00"))
+		buf = buf[end:]
+
+		switch {
+		case mask&syscall.IN_Q_OVERFLOW != 0: // events were lost, assume the worst
+			relevant = true
+		case mask&syscall.IN_IGNORED != 0: // the directory is gone
+			delete(w.dirs, wd)
+		default:
+			dir, ok := w.dirs[wd]
+			if !ok || name == "" {
+				continue
+			}
+			changed := path.Join(dir, name)
+			if s.shouldExcludeFile(s.path(changed)) {
+				continue // e.g. build output next to the sources
+			}
+			if mask&syscall.IN_ISDIR != 0 || s.Config.DetectLanguage(s.path(changed)) != "" {
+				relevant = true
+			}
+		}
+	}
+
+	return relevant
+}
+
+// close implements changeWatcher
+func (w *inotifyWatcher) close() error {
+	return syscall.Close(w.fd)
+}
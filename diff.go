@@ -0,0 +1,163 @@
+// loc - line count differences between two revisions or directories
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"loc/counter"
+)
+
+// writeDiffText writes the report as tables of changed files and languages, with + for added, - for removed
+// and ~ for modified lines
+func writeDiffText(w io.Writer, report *counter.DiffReport) error {
+	header := "\tCode +\tCode -\tCode ~\tComment +\tComment -\tComment ~\tBlank +\tBlank -\n"
+	row := func(tw io.Writer, name string, c counter.DiffCounts) {
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", name,
+			c.Code.Added, c.Code.Removed, c.Code.Modified,
+			c.Comment.Added, c.Comment.Removed, c.Comment.Modified,
+			c.Blank.Added, c.Blank.Removed)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprint(tw, "File"+header)
+	for _, file := range report.Files {
+		row(tw, file.Path+" ("+file.Status+")", file.DiffCounts)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintln(w)
+
+	languages := make([]string, 0, len(report.Languages))
+	for language := range report.Languages {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprint(tw, "Language"+header)
+	for _, language := range languages {
+		row(tw, language, report.Languages[language])
+	}
+	row(tw, "Total", report.Total)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(report.Binary) > 0 || len(report.TooLarge) > 0 || len(report.InvalidNotebooks) > 0 {
+		_, _ = fmt.Fprintln(w)
+	}
+	if len(report.Binary) > 0 {
+		writeSkippedText(w, "binary files", report.Binary, true)
+	}
+	if len(report.TooLarge) > 0 {
+		writeSkippedText(w, "files over the size limit", report.TooLarge, true)
+	}
+	if len(report.InvalidNotebooks) > 0 {
+		writeSkippedText(w, "invalid notebooks", report.InvalidNotebooks, true)
+	}
+	return nil
+}
+
+// writeDiffJSON writes the report as JSON
+func writeDiffJSON(w io.Writer, report *counter.DiffReport) error {
+	if report.Files == nil {
+		report.Files = []counter.FileDiff{} // no changes is an empty list, not null
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// runDiff runs the diff command, comparing two revisions of a repository or two directories
+func runDiff(args []string) error {
+	var excludePatterns excludeFlags
+	var opts counter.Options
+
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	dir := flags.String("dir", ".", "repository to read revisions from")
+	format := flags.String("format", "text", "output format: text or json")
+	countFlags(flags, &opts, &excludePatterns)
+	timeout := flags.Duration("timeout", 0, "stop after this long, e.g. 30s or 5m (0 for no limit)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	write := writeDiffText
+	switch *format {
+	case "text":
+	case "json":
+		write = writeDiffJSON
+	default:
+		return fmt.Errorf("invalid format '%s', expected text or json", *format)
+	}
+
+	var err error
+	opts.ExcludePatterns = excludePatterns
+	opts.Config, err = counter.LoadConfig(counter.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(*timeout)
+	defer cancel()
+
+	var report *counter.DiffReport
+	switch {
+	case flags.NArg() == 1 && strings.Contains(flags.Arg(0), ".."): // base..head or base...head
+		base, head, _ := strings.Cut(flags.Arg(0), "..")
+		if strings.HasPrefix(head, ".") { // compare head against where it forked from base
+			head = head[1:]
+			if base, err = counter.MergeBase(ctx, *dir, base, head); err != nil {
+				return err
+			}
+		}
+		report, err = counter.DiffRevisions(ctx, *dir, base, head, opts)
+	case flags.NArg() == 2: // two directories
+		report, err = counter.DiffDirs(ctx, flags.Arg(0), flags.Arg(1), opts)
+	default:
+		return fmt.Errorf("expected a revision range base..head or two directories")
+	}
+	if err != nil {
+		return err
+	}
+
+	return write(os.Stdout, report)
+}
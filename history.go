@@ -0,0 +1,144 @@
+// loc - line count history of a git repository
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"loc/counter"
+)
+
+// writeHistoryCSV writes the samples as CSV with a column per language
+func writeHistoryCSV(w io.Writer, samples []counter.Sample) error {
+	// collect every language seen over the history so all rows have the same columns
+	languageSet := make(map[string]bool)
+	for _, sample := range samples {
+		for language := range sample.Languages {
+			languageSet[language] = true
+		}
+	}
+	languages := make([]string, 0, len(languageSet))
+	for language := range languageSet {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(append([]string{"commit", "date", "total"}, languages...)); err != nil {
+		return err
+	}
+	for _, sample := range samples {
+		row := []string{sample.Commit, sample.Date.Format(time.RFC3339), strconv.Itoa(sample.TotalLines)}
+		for _, language := range languages {
+			row = append(row, strconv.Itoa(sample.Languages[language]))
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// writeHistoryJSON writes the samples as a JSON array
+func writeHistoryJSON(w io.Writer, samples []counter.Sample) error {
+	if samples == nil {
+		samples = []counter.Sample{} // an empty history is an empty array, not null
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(samples)
+}
+
+// runHistory runs the history command, printing a time series of line counts
+func runHistory(args []string) error {
+	var excludePatterns excludeFlags
+	var opts counter.Options
+
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	since := flags.String("since", "", "only sample commits after this date, e.g. 2024-01-01")
+	until := flags.String("until", "", "only sample commits before this date")
+	every := flags.String("every", "month", "sampling interval: commit, day, week, month or year")
+	format := flags.String("format", "csv", "output format: csv or json")
+	rev := flags.String("rev", "HEAD", "git revision whose first-parent history is walked")
+	countFlags(flags, &opts, &excludePatterns)
+	timeout := flags.Duration("timeout", 0, "stop after this long, e.g. 30s or 5m (0 for no limit)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	directory := "."
+	if flags.NArg() > 0 { // the repository directory
+		directory = flags.Arg(0)
+	}
+
+	write := writeHistoryCSV
+	switch *format {
+	case "csv":
+	case "json":
+		write = writeHistoryJSON
+	default:
+		return fmt.Errorf("invalid format '%s', expected csv or json", *format)
+	}
+
+	var err error
+	opts.ExcludePatterns = excludePatterns
+	opts.Config, err = counter.LoadConfig(counter.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(*timeout)
+	defer cancel()
+
+	samples, err := counter.History(ctx, directory, counter.HistoryOptions{
+		Options: opts,
+		Rev:     *rev,
+		Since:   *since,
+		Until:   *until,
+		Every:   *every,
+	})
+	if err != nil {
+		return err
+	}
+
+	return write(os.Stdout, samples)
+}
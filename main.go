@@ -31,270 +31,278 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
+	"os/signal"
+	"strconv"
 	"strings"
+	"time"
+
+	"loc/counter"
 )
 
-// Loc is the main struct for the Loc program
-type Loc struct {
-	TotalLines      int              // Total number of lines of code
-	Config          *Config          // The Loc configuration
-	Directory       string           // The directory to scan
-	ExcludePatterns []*regexp.Regexp // Compiled regex patterns for file exclusion
-}
+// Custom flag type for collecting multiple exclude patterns
+type excludeFlags []string
 
-// LanguageConfig is the configuration for a language
-type LanguageConfig struct {
-	SkipPatterns []string `json:"skip_patterns"` // Patterns to skip; lines matching these patterns will not be counted
-	Extensions   []string `json:"extensions"`    // File extensions to count
+// String implements the flag.Value interface for excludeFlags
+func (e *excludeFlags) String() string {
+	return strings.Join(*e, ", ")
 }
 
-// Config is the configuration for Loc
-type Config struct {
-	Languages map[string]LanguageConfig `json:"languages"`
+// Set implements the flag.Value interface for excludeFlags
+func (e *excludeFlags) Set(value string) error {
+	*e = append(*e, value)
+	return nil
 }
 
-// CONFIG_FILE is the name of the configuration file
-const CONFIG_FILE = "config.json"
-
-// readConfig reads the Loc configuration file
-func readConfig() (*Config, error) {
-	// get working directory
-	wd, err := os.Getwd()
-	if err != nil {
-		return nil, err
-	}
-
-	// read the config files contents into memory
-	configFile, err := os.ReadFile(wd + string(os.PathSeparator) + CONFIG_FILE)
-	if err != nil {
-		return nil, err
-	}
-
-	// create config variable
-	var config Config
-
-	// unmarshal the config file into the config variable
-	err = json.Unmarshal(configFile, &config)
-	if err != nil {
-		return nil, err
-	}
+// Custom flag type for sizes in bytes, with an optional K, M or G suffix for KiB, MiB or GiB
+type sizeFlag int64
 
-	// return the config variable
-	return &config, nil
+// String implements the flag.Value interface for sizeFlag
+func (s *sizeFlag) String() string {
+	return strconv.FormatInt(int64(*s), 10)
 }
 
-// shouldExcludeFile checks if a file or directory should be excluded based on patterns
-func (loc *Loc) shouldExcludeFile(path string) bool {
-	// Get the base name and relative path for pattern matching
-	baseName := filepath.Base(path)
-	relPath := strings.TrimPrefix(path, loc.Directory)
-	relPath = strings.TrimPrefix(relPath, string(os.PathSeparator))
-
-	// Check against all exclusion patterns
-	for _, pattern := range loc.ExcludePatterns {
-		// Check against full relative path
-		if pattern.MatchString(relPath) {
-			return true
-		}
-		// Check against base name
-		if pattern.MatchString(baseName) {
-			return true
-		}
-		// Check against full path
-		if pattern.MatchString(path) {
-			return true
+// Set implements the flag.Value interface for sizeFlag
+func (s *sizeFlag) Set(value string) error {
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B") // 10MB is 10M
+	multiplier := int64(1)
+	for i, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(number, suffix) {
+			number = strings.TrimSuffix(number, suffix)
+			multiplier = 1 << (10 * (i + 1))
 		}
 	}
 
-	return false
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid size '%s', expected bytes or a number with K, M or G", value)
+	}
+	*s = sizeFlag(size * multiplier)
+	return nil
 }
 
-// scan scans the directory and counts the lines of code
-func (loc *Loc) scan() error {
-	// Walk the directory
-	return filepath.Walk(loc.Directory, func(path string, info os.FileInfo, err error) error {
-		if err != nil { // if there is an error, return the error
-			return err
-		}
-
-		// Check if this file or directory should be excluded
-		if loc.shouldExcludeFile(path) {
-			if info.IsDir() {
-				return filepath.SkipDir // Skip entire directory
-			}
-			return nil // Skip this file
-		}
-
-		if !info.IsDir() { // if the file is not a directory we can count the lines of code
-			for _, langConfig := range loc.Config.Languages { // iterate over configured languages
-				for _, ext := range langConfig.Extensions { // iterate over the extensions for the language
-					if strings.HasSuffix(path, ext) { // if the file has the correct extension
-						lines, err := loc.countLines(path, langConfig.SkipPatterns) // count the lines of code
-						if err != nil {
-							return err
-						}
-						loc.TotalLines += lines // add the lines of code to the total
-					}
-				}
-			}
-		}
-		return nil
-	})
+// limitFlags adds the flags limiting how far the walk of a directory goes to flags
+func limitFlags(flags *flag.FlagSet, opts *counter.Options) {
+	flags.IntVar(&opts.MaxDepth, "max-depth", 0, "count files at most this many directories deep, 1 for the files of the directory itself; 0 for no limit")
+	flags.Var((*sizeFlag)(&opts.MaxFileSize), "max-file-size", "skip files larger than this, e.g. 512K or 10M, and list them; 0 for no limit")
+	flags.BoolVar(&opts.Hidden, "hidden", false, "walk hidden directories, only .github, .gitlab, .circleci and those in the config are walked otherwise")
+	flags.BoolVar(&opts.OneFileSystem, "one-file-system", false, "do not walk directories on other filesystems, such as mount points")
 }
 
-// countLines counts the lines of code in a file
-func (loc *Loc) countLines(filePath string, skipPatterns []string) (int, error) {
-	// we need to open the file
-	file, err := os.Open(filePath)
-	if err != nil {
-		return 0, err
-	}
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file) // defer the closure of the file
-
-	scanner := bufio.NewScanner(file) // create a scanner for the file
-
-	totalLines := 0 // total lines of code in the file
-
-	// create a slice of regular expressions for the skip patterns
-	skipRegexps := make([]*regexp.Regexp, len(skipPatterns))
-	for i, pattern := range skipPatterns {
-		skipRegexps[i] = regexp.MustCompile(pattern) // compile the regular expression
-	}
-
-	for scanner.Scan() { // iterate over the lines of the file
-		line := scanner.Text() // get the line of the file
-		skip := false          // set skip to false
-		for _, re := range skipRegexps {
-			if re.MatchString(line) { // if the line matches the regular expression we skip it
-				skip = true
-				break
-			}
-		}
-		if !skip { // if we are not skipping the line we increment the total lines
-			totalLines++
+// commandContext returns a context that is cancelled on SIGINT or once timeout has passed, if it is set.
+// After the first interrupt the default handling is restored, so a second Ctrl-C exits immediately.
+func commandContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	cancel := stop
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		cancel = func() {
+			cancelTimeout()
+			stop()
 		}
 	}
 
-	// check for scanner errors
-	if err := scanner.Err(); err != nil {
-		return 0, err
-	}
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	return totalLines, nil
+	return ctx, cancel
 }
 
-// cloneRepo clones a GitHub repository to a temporary directory
-func cloneRepo(repoURL string) (string, error) {
-	tempDir, err := os.MkdirTemp("", "loc-repo-") // create a temporary directory
-	if err != nil {
-		return "", err
-	}
-
-	cmd := exec.Command("git", "clone", repoURL, tempDir)
-	err = cmd.Run()
-	if err != nil {
-		_ = os.RemoveAll(tempDir)
-		return "", err
-	}
-
-	return tempDir, nil
+// interrupted reports whether err is the result of an interrupt or a timeout
+func interrupted(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
 }
 
-// compileExcludePatterns compiles the exclude patterns into regular expressions
-func compileExcludePatterns(patterns []string) ([]*regexp.Regexp, error) {
-	var compiledPatterns []*regexp.Regexp
-
-	for _, pattern := range patterns {
-		// Compile the regex pattern directly (no glob conversion)
-		compiled, err := regexp.Compile(pattern)
-		if err != nil {
-			return nil, fmt.Errorf("invalid exclude pattern '%s': %v", pattern, err)
+func main() {
+	// run a command if one is given
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "history":
+			if err := runHistory(os.Args[2:]); err != nil {
+				fmt.Println("Error building history:", err)
+				os.Exit(1)
+			}
+			return
+		case "diff":
+			if err := runDiff(os.Args[2:]); err != nil {
+				fmt.Println("Error comparing:", err)
+				os.Exit(1)
+			}
+			return
+		case "watch":
+			if err := runWatch(os.Args[2:]); err != nil {
+				fmt.Println("Error watching:", err)
+				os.Exit(1)
+			}
+			return
+		case "snapshot":
+			if err := runSnapshot(os.Args[2:]); err != nil {
+				fmt.Println("Error writing snapshot:", err)
+				os.Exit(1)
+			}
+			return
+		case "compare":
+			if err := runCompare(os.Args[2:]); err != nil {
+				fmt.Println("Error comparing with snapshot:", err)
+				os.Exit(1)
+			}
+			return
+		case "cache":
+			if err := runCache(os.Args[2:]); err != nil {
+				fmt.Println("Error pruning cache:", err)
+				os.Exit(1)
+			}
+			return
 		}
-
-		compiledPatterns = append(compiledPatterns, compiled)
 	}
 
-	return compiledPatterns, nil
-}
-
-// Custom flag type for collecting multiple exclude patterns
-type excludeFlags []string
-
-// String implements the flag.Value interface for excludeFlags
-func (e *excludeFlags) String() string {
-	return strings.Join(*e, ", ")
-}
-
-// Set implements the flag.Value interface for excludeFlags
-func (e *excludeFlags) Set(value string) error {
-	*e = append(*e, value)
-	return nil
-}
-
-func main() {
-	var err error // global error variable
-	loc := Loc{}  // create a new Loc struct
+	var err error             // global error variable
+	opts := counter.Options{} // options for the count
+	output := reportOutput{}  // how the counts are written
+
+	// exit non-zero for CI once everything else, like removing a clone, is done. A policy that could not
+	// be checked fails as well, so a broken policy, a failed clone or an interrupted count never passes as
+	// within budget.
+	policyFailed := false
+	defer func() {
+		if policyFailed {
+			os.Exit(1)
+		}
+	}()
 
 	var excludePatterns excludeFlags
 
-	dir := flag.String("dir", ".", "directory to count lines of code")                                               // create a flag for the directory
-	repo := flag.String("repo", ".", "github repository to count lines of code")                                     // create a flag for a repository
-	flag.Var(&excludePatterns, "exclude", "regex pattern to exclude files/directories (can be used multiple times)") // used to skip over files and directories that match the given regex patterns
+	dir := flag.String("dir", ".", "directory to count lines of code")                                     // create a flag for the directory
+	repo := flag.String("repo", "", "github repository to count lines of code")                            // create a flag for a repository
+	countFlags(flag.CommandLine, &opts, &excludePatterns)                                                  // the flags selecting the files, shared with the other commands
+	flag.StringVar(&opts.Rev, "rev", "", "git commit, tag or branch to count instead of the working tree") // read from the object store, the working copy is left untouched
+	ref := flag.String("ref", "", "branch, tag or commit to clone with -repo")
+	cloneDepth := flag.Int("clone-depth", 1, "number of commits of history to clone with -repo, 0 for the full history")
+	submodules := flag.Bool("submodules", false, "check out submodules recursively with -repo")
+	timeout := flag.Duration("timeout", 0, "stop cloning and counting after this long, e.g. 30s or 5m (0 for no limit)")
+	flag.StringVar(&opts.CacheDir, "cache-dir", "", "directory to cache per-file counts in, so unchanged files are not counted again")
+	flag.BoolVar(&opts.CacheHash, "cache-hash", false, "with -cache-dir, recognise unchanged files by a hash of their contents instead of size and mtime")
+	flag.StringVar(&output.By, "by", "", "break the counts down: dir for a tree of directories")
+	flag.StringVar(&output.Format, "format", "text", "output format: text or json")
+	flag.IntVar(&output.Depth, "depth", 1, "levels of directories to show with -by dir, 0 for all")
+	flag.StringVar(&output.Sort, "sort", "name", "order of the directories with -by dir: name, code or lines")
+	flag.IntVar(&output.Top, "top", 0, "list this many of the largest files by lines of code, and the files that stand out")
+	output.Outliers = counter.DefaultOutlierOptions
+	flag.IntVar(&output.Outliers.MaxLines, "outlier-lines", output.Outliers.MaxLines, "with -top, files with more lines of code stand out; 0 to disable")
+	policyFile := flag.String("policy", "", "policy file with line budgets to check, "+counter.PolicyFile+" in the directory by default")
+	flag.BoolVar(&output.Verbose, "verbose", false, "list the files skipped as binary, for their size or as invalid notebooks, and the broken links")
+	flag.BoolVar(&output.MixedLineEndings, "mixed-endings", false, "list the files that mix \\n, \\r\\n and \\r line endings")
+	progress := flag.Bool("progress", true, "show progress on stderr while counting, only when stderr is a terminal")
 
 	flag.Parse() // parse the flags
 
-	loc.Directory = *dir // set the directory
+	// Ctrl-C or the timeout stops the clone or the scan, the deferred cleanup below still runs
+	ctx, cancel := commandContext(*timeout)
+	defer cancel()
 
-	// Compile exclude patterns if any were provided
-	if len(excludePatterns) > 0 {
-		loc.ExcludePatterns, err = compileExcludePatterns(excludePatterns)
-		if err != nil {
-			fmt.Println("Error compiling exclude patterns:", err)
-			return
-		}
+	if flag.NArg() > 0 { // a directory may also be given as an argument
+		*dir = flag.Arg(0)
+	}
+
+	directory := *dir // the directory to count
+	opts.ExcludePatterns = excludePatterns
+	opts.Files = output.files() // the tree and the largest files are found from the counts of every file
+
+	if err := output.validate(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
 	}
 
 	// directory supercedes repo
-	if loc.Directory == "" { // if the directory is empty
+	if directory == "" { // if the directory is empty
 		fmt.Println("Directory is empty") // print an error
 		os.Exit(1)
-	} else {
-		if *repo != "" {
-			loc.Directory, err = cloneRepo(*repo)
-			if err != nil {
-				fmt.Println("Error cloning repository:", err)
-				return
-			}
-			defer func(path string) {
-				_ = os.RemoveAll(path)
-			}(loc.Directory)
-		} else {
-			loc.Directory = *dir
+	} else if *repo != "" {
+		cloneOpts := counter.CloneOptions{Ref: *ref, Depth: *cloneDepth, Submodules: *submodules}
+		if opts.Rev != "" { // the revision may be anywhere in the history
+			cloneOpts.Depth = 0
 		}
+		directory, err = counter.Clone(ctx, *repo, cloneOpts)
+		if err != nil {
+			fmt.Println("Error cloning repository:", err)
+			policyFailed = *policyFile != ""
+			return
+		}
+		defer func(path string) {
+			_ = os.RemoveAll(path)
+		}(directory)
 	}
+
 	// Read the config
-	loc.Config, err = readConfig()
+	opts.Config, err = counter.LoadConfig(counter.ConfigFile)
 	if err != nil {
 		fmt.Println("Error reading config:", err)
+		policyFailed = *policyFile != ""
 		return
 	}
 
-	// Scan the directory and count lines of code
-	err = loc.scan()
-	if err != nil {
+	// Read the line budgets, from the clone when counting a repository
+	var policy *counter.Policy
+	policyPath := findPolicy(*policyFile, directory)
+	if policyPath != "" {
+		policy, err = counter.LoadPolicy(policyPath)
+		if err != nil {
+			fmt.Println("Error reading policy:", err)
+			policyFailed = true
+			return
+		}
+		opts.Files = true // budgets per file and directory need the counts of every file
+	}
+
+	// Keep the terminal busy on large trees, piped or redirected output stays clean
+	var printer *progressPrinter
+	if *progress && isTerminal(os.Stderr) {
+		printer = newProgressPrinter(os.Stderr)
+		opts.Progress = printer.update
+	}
+
+	// Scan the directory, revision or archive and count lines of code
+	report, err := counter.Count(ctx, directory, opts)
+	if printer != nil {
+		printer.clear() // the results start on a clean line
+	}
+	partial := err != nil && interrupted(err) && report != nil
+	if partial {
+		// print what was counted before the interrupt, marked as partial on stderr so JSON stays parsable
+		_, _ = fmt.Fprintln(os.Stderr, "Scan interrupted, the counts below are partial:", err)
+	} else if err != nil {
 		fmt.Println("Error scanning directory:", err)
+		policyFailed = policy != nil || *policyFile != ""
 		return
 	}
 
-	fmt.Printf("Total lines of code: %d\n", loc.TotalLines) // print the total lines of code
+	// print the total lines of code, or the breakdown asked for
+	if err := output.write(os.Stdout, report); err != nil {
+		fmt.Println("Error writing report:", err)
+	}
+
+	// Check the budgets of a complete count, keeping JSON output parsable
+	if policy != nil {
+		w := os.Stdout
+		if output.Format == "json" {
+			w = os.Stderr
+		}
+		if partial { // the files that were not reached may be over budget
+			_, _ = fmt.Fprintf(w, "Policy %s: not checked, the count is partial\n", policyPath)
+			policyFailed = true
+			return
+		}
+		ok, err := checkPolicy(w, policyPath, policy, report)
+		if err != nil {
+			_, _ = fmt.Fprintln(w, "Error checking policy:", err)
+		}
+		policyFailed = !ok
+	}
 }
@@ -32,14 +32,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"io"
-	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"loc/counter"
 )
 
 func TestMainFunction(t *testing.T) {
@@ -87,510 +92,717 @@ func TestMainFunction(t *testing.T) {
 	}
 }
 
-func setupTestDirectory(t *testing.T) string {
-	tempDir, err := os.MkdirTemp("", "loc-test-")
+// mainArgsEnv holds the arguments of main when the test binary runs it for runMain
+const mainArgsEnv = "LOC_TEST_MAIN_ARGS"
+
+// TestMainProcess runs main in the child process started by runMain, and is skipped otherwise
+func TestMainProcess(t *testing.T) {
+	args, ok := os.LookupEnv(mainArgsEnv)
+	if !ok {
+		t.Skip("only runs main for runMain")
+	}
+	os.Args = append([]string{"loc"}, strings.Split(args, "\n")...)
+	main()
+	os.Exit(0) // main returned without exiting, as it does on success
+}
+
+// runMain runs main with args in a child process, as from the command line, and returns its output and
+// exit code, so the exit code of main can be checked
+func runMain(t *testing.T, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	return runMainIn(t, "", args...)
+}
+
+// runMainIn is runMain with dir as the working directory, the current one when empty
+func runMainIn(t *testing.T, dir string, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+
+	executable, err := filepath.Abs(os.Args[0])
 	if err != nil {
-		t.Fatalf("Failed to create temp directory: %v", err)
+		t.Fatalf("Failed to find the test binary: %v", err)
 	}
+	cmd := exec.Command(executable, "-test.run=^TestMainProcess$")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), mainArgsEnv+"="+strings.Join(args, "\n"))
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("Failed to run main: %v", err)
+	}
+	return outBuf.String(), errBuf.String(), code
+}
 
-	dirs := []string{
-		"src",
-		"src/tests",
-		"build",
-		"node_modules/package",
-		"gen",
-		".git",
+func TestMainInterrupted(t *testing.T) {
+	// a count stopped by the timeout prints what it counted, the notice goes to stderr
+	stdout, stderr, _ := runMain(t, "-timeout", "1ns", "-progress=false", "-format", "json", "test_dir")
+	var report counter.Report
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+		t.Errorf("Expected JSON on stdout, got %q: %v", stdout, err)
 	}
+	if !strings.Contains(stderr, "Scan interrupted") {
+		t.Errorf("Expected the interrupt on stderr, got %q", stderr)
+	}
+}
 
-	for _, dir := range dirs {
-		err := os.MkdirAll(filepath.Join(tempDir, dir), 0755)
-		if err != nil {
-			t.Fatalf("Failed to create directory %s: %v", dir, err)
-		}
+func TestMainPolicyExitCode(t *testing.T) {
+	// CI relies on the exit code, a policy that was not checked must not pass
+	policies := map[string]string{
+		"generous.json":  `{"total": {"max_lines": 1000000}}`,
+		"strict.json":    `{"total": {"max_lines": 1}}`,
+		"malformed.json": `{"max_file_line": 100}`,
 	}
-	// Create some test files with various contents
-	files := map[string]string{
-		"main.go":                       "package main\n\nfunc main() {\n\tprintln(\"hello\")\n}\n",
-		"src/utils.go":                  "package src\n\nfunc Add(a, b int) int {\n\treturn a + b\n}\n",
-		"src/utils_test.go":             "package src\n\nimport \"testing\"\n\nfunc TestAdd(t *testing.T) {\n\t// test code\n}\n",
-		"src/tests/integration.go":      "package tests\n\n// integration test\nfunc TestIntegration() {\n}\n",
-		"app.spec.ts":                   "describe('app', () => {\n\tit('works', () => {\n\t\t// test\n\t});\n});\n",
-		"component.test.js":             "test('component', () => {\n\t// test code\n});\n",
-		"build/output.go":               "// generated file\npackage main\n\nvar Generated = true\n",
-		"gen/models.go":                 "// Auto-generated file\npackage gen\n\ntype Model struct{}\n",
-		"node_modules/package/index.js": "module.exports = {};\n",
-		".git/config":                   "[core]\n\trepositoryformatversion = 0\n",
-		"README.md":                     "# Test Project\n\nThis is a test.\n",
-	}
-
-	for file, content := range files {
-		filePath := filepath.Join(tempDir, file)
-		fileDir := filepath.Dir(filePath)
-		err := os.MkdirAll(fileDir, 0755)
-		if err != nil {
-			t.Fatalf("Failed to create directory for file %s: %v", file, err)
+	dir := t.TempDir()
+	for name, content := range policies {
+		if err := os.WriteFile(dir+"/"+name, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write policy: %v", err)
 		}
+	}
 
-		err = os.WriteFile(filePath, []byte(content), 0644)
-		if err != nil {
-			t.Fatalf("Failed to create file %s: %v", file, err)
-		}
+	tests := []struct {
+		name     string
+		workDir  string // without config.json when set
+		args     []string
+		expected int
+	}{
+		{name: "Within budget", args: []string{"-policy", dir + "/generous.json", "test_dir"}, expected: 0},
+		{name: "Over budget", args: []string{"-policy", dir + "/strict.json", "test_dir"}, expected: 1},
+		{name: "Malformed policy", args: []string{"-policy", dir + "/malformed.json", "test_dir"}, expected: 1},
+		{name: "Scan error", args: []string{"-policy", dir + "/generous.json", dir + "/missing"}, expected: 1},
+		{name: "Partial count", args: []string{"-policy", dir + "/generous.json", "-timeout", "1ns", "test_dir"}, expected: 1},
+		{name: "Scan error without a policy", args: []string{dir + "/missing"}, expected: 0},
+		{name: "Clone error", args: []string{"-policy", dir + "/generous.json", "-repo", dir + "/missing"}, expected: 1},
+		{name: "Missing ref", args: []string{"-policy", dir + "/generous.json", "-repo", ".", "-ref", "nosuchref"}, expected: 1},
+		{name: "Clone error without a policy", args: []string{"-repo", dir + "/missing"}, expected: 0},
+		{name: "Config error", workDir: dir, args: []string{"-policy", dir + "/generous.json", dir}, expected: 1},
 	}
 
-	config := Config{
-		Languages: map[string]LanguageConfig{
-			"go": {
-				Extensions:   []string{".go"},
-				SkipPatterns: []string{`^\s*//`, `^\s*$`}, // Skip comments and empty lines
-			},
-			"typescript": {
-				Extensions:   []string{".ts"},
-				SkipPatterns: []string{`^\s*//`, `^\s*$`},
-			},
-			"javascript": {
-				Extensions:   []string{".js"},
-				SkipPatterns: []string{`^\s*//`, `^\s*$`},
-			},
-			"markdown": {
-				Extensions:   []string{".md"},
-				SkipPatterns: []string{`^\s*$`},
-			},
-		},
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, code := runMainIn(t, tt.workDir, append([]string{"-progress=false"}, tt.args...)...)
+			if code != tt.expected {
+				t.Errorf("Expected exit code %d, got %d with output %q", tt.expected, code, stdout)
+			}
+		})
 	}
+}
 
-	configData, err := json.MarshalIndent(config, "", "  ")
+func TestExcludeFlagsType(t *testing.T) {
+	var flags excludeFlags
+
+	err := flags.Set("pattern1")
 	if err != nil {
-		t.Fatalf("Failed to marshal config: %v", err)
+		t.Errorf("Unexpected error: %v", err)
 	}
 
-	configPath := filepath.Join(tempDir, "config.json")
-	err = os.WriteFile(configPath, configData, 0644)
+	err = flags.Set("pattern2")
 	if err != nil {
-		t.Fatalf("Failed to create config file: %v", err)
+		t.Errorf("Unexpected error: %v", err)
 	}
 
-	return tempDir
-}
+	expected := "pattern1, pattern2"
+	if flags.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, flags.String())
+	}
 
-func TestExcludePatterns(t *testing.T) {
-	testDir := setupTestDirectory(t)
-	defer func(path string) {
-		_ = os.RemoveAll(path)
-	}(testDir)
+	if len(flags) != 2 {
+		t.Errorf("Expected 2 flags, got %d", len(flags))
+	}
+}
 
-	originalWd, err := os.Getwd()
-	if err != nil {
-		t.Fatalf("Failed to get working directory: %v", err)
+func TestSizeFlagType(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int64
+		valid    bool
+	}{
+		{"0", 0, true},
+		{"1500", 1500, true},
+		{"512K", 512 << 10, true},
+		{"10M", 10 << 20, true},
+		{"10mb", 10 << 20, true},
+		{"2G", 2 << 30, true},
+		{"100B", 100, true},
+		{"-1", 0, false},
+		{"big", 0, false},
+		{"1.5M", 0, false},
 	}
-	defer func(dir string) {
-		_ = os.Chdir(dir)
-	}(originalWd)
 
-	err = os.Chdir(testDir)
-	if err != nil {
-		t.Fatalf("Failed to change to test directory: %v", err)
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var size sizeFlag
+			err := size.Set(tt.value)
+			if (err == nil) != tt.valid {
+				t.Fatalf("Expected valid to be %v, got error %v", tt.valid, err)
+			}
+			if int64(size) != tt.expected {
+				t.Errorf("Expected %d bytes, got %d", tt.expected, size)
+			}
+		})
 	}
+}
+
+func TestMainWithExcludeFlags(t *testing.T) {
+	origArgs := os.Args
+	defer func() {
+		os.Args = origArgs
+	}()
 
 	tests := []struct {
-		name            string
-		excludePatterns []string
-		expectedFiles   []string
-		excludedFiles   []string
+		name        string
+		args        []string
+		expectError bool
+		shouldCount bool
 	}{
 		{
-			name:            "No exclusions",
-			excludePatterns: []string{},
-			expectedFiles: []string{
-				"main.go",
-				"src/utils.go",
-				"src/utils_test.go",
-				"src/tests/integration.go",
-				"app.spec.ts",
-				"component.test.js",
-				"build/output.go",
-				"gen/models.go",
-				"node_modules/package/index.js",
-				"README.md",
-			},
-		},
-		{
-			name:            "Exclude test files",
-			excludePatterns: []string{`.*_test\.go$`, `.*\.spec\.ts$`, `.*\.test\.js$`},
-			expectedFiles: []string{
-				"main.go",
-				"src/utils.go",
-				"src/tests/integration.go",
-				"build/output.go",
-				"gen/models.go",
-				"node_modules/package/index.js",
-				"README.md",
-			},
-			excludedFiles: []string{
-				"src/utils_test.go",
-				"app.spec.ts",
-				"component.test.js",
-			},
+			name:        "Basic directory scan",
+			args:        []string{"cmd", "-dir", "test_dir"},
+			expectError: false,
+			shouldCount: true,
 		},
 		{
-			name:            "Exclude directories",
-			excludePatterns: []string{`node_modules/.*`, `\.git/.*`, `build/.*`},
-			expectedFiles: []string{
-				"main.go",
-				"src/utils.go",
-				"src/utils_test.go",
-				"src/tests/integration.go",
-				"app.spec.ts",
-				"component.test.js",
-				"gen/models.go",
-				"README.md",
-			},
-			excludedFiles: []string{
-				"build/output.go",
-				"node_modules/package/index.js",
-			},
+			name:        "Exclude test files",
+			args:        []string{"cmd", "-dir", "test_dir", "--exclude", `.*_test\.go$`, "--exclude", `.*\.spec\.ts$`},
+			expectError: false,
+			shouldCount: true,
 		},
 		{
-			name:            "Exclude generated and test files",
-			excludePatterns: []string{`gen/.*`, `.*_test\.go$`, `tests/.*`},
-			expectedFiles: []string{
-				"main.go",
-				"src/utils.go",
-				"app.spec.ts",
-				"component.test.js",
-				"build/output.go",
-				"node_modules/package/index.js",
-				"README.md",
-			},
-			excludedFiles: []string{
-				"gen/models.go",
-				"src/utils_test.go",
-				"src/tests/integration.go",
-			},
+			name:        "Exclude directories",
+			args:        []string{"cmd", "-dir", "test_dir", "--exclude", `node_modules/.*`, "--exclude", `\.git/.*`},
+			expectError: false,
+			shouldCount: true,
 		},
 		{
-			name: "Complex exclusion patterns",
-			excludePatterns: []string{
-				`.*_test\.go$`,  // Go test files
-				`.*\.spec\.ts$`, // TypeScript spec files
-				`.*\.test\.js$`, // JavaScript test files
-				`/tests/`,       // Test directories
-				`node_modules/`, // Node modules
-				`build/`,        // Build directory
-			},
-			expectedFiles: []string{
-				"main.go",
-				"src/utils.go",
-				"gen/models.go",
-				"README.md",
-			},
-			excludedFiles: []string{
-				"src/utils_test.go",
-				"src/tests/integration.go",
-				"app.spec.ts",
-				"component.test.js",
-				"build/output.go",
-				"node_modules/package/index.js",
-			},
+			name:        "Invalid regex pattern",
+			args:        []string{"cmd", "-dir", "test_dir", "--exclude", `[`},
+			expectError: true,
+			shouldCount: false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			loc := &Loc{
-				Directory: testDir,
-			}
-
-			config, err := readConfig()
-			if err != nil {
-				t.Fatalf("Failed to read config: %v", err)
-			}
-			loc.Config = config
-
-			if len(tt.excludePatterns) > 0 {
-				compiledPatterns, err := compileExcludePatterns(tt.excludePatterns)
-				if err != nil {
-					t.Fatalf("Failed to compile exclude patterns: %v", err)
-				}
-				loc.ExcludePatterns = compiledPatterns
-			}
-
-			processedFiles := make(map[string]bool)
+			flag.CommandLine = flag.NewFlagSet(tt.args[0], flag.ContinueOnError)
 
-			err = filepath.Walk(loc.Directory, func(path string, info fs.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
+			var buf bytes.Buffer
+			flag.CommandLine.SetOutput(&buf)
 
-				// Skip if excluded
-				if loc.shouldExcludeFile(path) {
-					if info.IsDir() {
-						return filepath.SkipDir
-					}
-					return nil
-				}
+			os.Args = tt.args
 
-				// Only track files, not directories
-				if !info.IsDir() {
-					relPath, _ := filepath.Rel(testDir, path)
-					// Skip config.json from tracking
-					if relPath != "config.json" {
-						processedFiles[relPath] = true
-					}
-				}
+			var excludePatterns excludeFlags
 
-				return nil
-			})
+			dir := flag.String("dir", ".", "directory to count lines of code")
+			flag.Var(&excludePatterns, "exclude", "regex pattern to exclude files/directories")
 
-			if err != nil {
-				t.Fatalf("Failed to walk directory: %v", err)
+			err := flag.CommandLine.Parse(tt.args[1:])
+			if err != nil && !tt.expectError {
+				t.Fatalf("Unexpected flag parsing error: %v", err)
 			}
-
-			// Check that expected files are processed
-			for _, expectedFile := range tt.expectedFiles {
-				if !processedFiles[expectedFile] {
-					t.Errorf("Expected file %s was not processed", expectedFile)
-				}
+			if err != nil && tt.expectError {
+				return // Expected error, test passed
 			}
 
-			// Check that excluded files are not processed
-			for _, excludedFile := range tt.excludedFiles {
-				if processedFiles[excludedFile] {
-					t.Errorf("Excluded file %s was processed", excludedFile)
-				}
+			config, err := counter.LoadConfig(counter.ConfigFile)
+			if err != nil {
+				t.Fatalf("Failed to read config: %v", err)
 			}
 
-			// Also test the actual line counting
-			loc.TotalLines = 0
-			err = loc.scan()
+			report, err := counter.Count(context.Background(), *dir, counter.Options{Config: config, ExcludePatterns: excludePatterns})
 			if err != nil {
-				t.Fatalf("Failed to scan directory: %v", err)
+				if tt.expectError {
+					return // Expected error
+				}
+				t.Fatalf("Failed to scan: %v", err)
+			}
+			if tt.expectError {
+				t.Fatal("Expected an error")
 			}
 
-			if loc.TotalLines == 0 && len(tt.expectedFiles) > 0 {
-				t.Error("Expected some lines to be counted but got 0")
+			if tt.shouldCount && report.Total.Code == 0 {
+				t.Error("Expected some lines to be counted")
 			}
 
-			t.Logf("Test %s: Processed %d files, counted %d lines",
-				tt.name, len(processedFiles), loc.TotalLines)
+			t.Logf("Test %s: Counted %d lines", tt.name, report.Total.Code)
 		})
 	}
 }
 
-func TestShouldExcludeFile(t *testing.T) {
-	loc := &Loc{
-		Directory: "/project",
+func TestWriteHistory(t *testing.T) {
+	samples := []counter.Sample{
+		{Commit: "a1", Date: time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC), TotalLines: 3, Languages: map[string]int{"go": 3}},
+		{Commit: "b2", Date: time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC), TotalLines: 8, Languages: map[string]int{"go": 6, "javascript": 2}},
 	}
 
-	patterns := []string{
-		`.*_test\.go$`,
-		`node_modules/.*`,
-		`\.git/.*`,
-		`gen/.*`,
+	// The CSV has a column per language and a row per sample
+	var out bytes.Buffer
+	if err := writeHistoryCSV(&out, samples); err != nil {
+		t.Fatalf("Failed to write CSV: %v", err)
+	}
+	expected := "commit,date,total,go,javascript\n" +
+		"a1,2024-01-15T12:00:00Z,3,3,0\n" +
+		"b2,2024-02-20T12:00:00Z,8,6,2\n"
+	if out.String() != expected {
+		t.Errorf("Expected CSV %q, got %q", expected, out.String())
 	}
 
-	compiledPatterns, err := compileExcludePatterns(patterns)
-	if err != nil {
-		t.Fatalf("Failed to compile patterns: %v", err)
+	out.Reset()
+	if err := writeHistoryJSON(&out, samples); err != nil {
+		t.Fatalf("Failed to write JSON: %v", err)
+	}
+	var decoded []counter.Sample
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if len(decoded) != 2 || decoded[1].Languages["javascript"] != 2 {
+		t.Errorf("Unexpected JSON history %+v", decoded)
 	}
-	loc.ExcludePatterns = compiledPatterns
 
-	tests := []struct {
-		path     string
-		expected bool
-	}{
-		{"/project/main.go", false},
-		{"/project/src/utils.go", false},
-		{"/project/src/utils_test.go", true},
-		{"/project/node_modules/package/index.js", true},
-		{"/project/.git/config", true},
-		{"/project/gen/models.go", true},
-		{"/project/build/output.go", false},
-		{"/project/app.spec.ts", false},
+	out.Reset()
+	if err := writeHistoryJSON(&out, nil); err != nil {
+		t.Fatalf("Failed to write JSON: %v", err)
+	}
+	if strings.TrimSpace(out.String()) != "[]" {
+		t.Errorf("Expected an empty array, got %q", out.String())
 	}
+}
 
-	for _, tt := range tests {
-		t.Run(tt.path, func(t *testing.T) {
-			result := loc.shouldExcludeFile(tt.path)
-			if result != tt.expected {
-				t.Errorf("shouldExcludeFile(%s) = %v, expected %v", tt.path, result, tt.expected)
-			}
-		})
+func TestWriteDiff(t *testing.T) {
+	counts := counter.DiffCounts{Code: counter.LineDelta{Added: 2, Removed: 1, Modified: 1}}
+	report := &counter.DiffReport{
+		Files:     []counter.FileDiff{{Path: "main.go", Language: "go", Status: "modified", DiffCounts: counts}},
+		Languages: map[string]counter.DiffCounts{"go": counts},
+		Total:     counts,
+		Binary:    []string{"data.py"},
+	}
+
+	var out bytes.Buffer
+	if err := writeDiffText(&out, report); err != nil {
+		t.Fatalf("Failed to write diff: %v", err)
+	}
+	for _, expected := range []string{"main.go (modified)  2", "go  ", "Total", "Skipped binary files: 1\n  data.py\n"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected text output to contain %q, got %q", expected, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := writeDiffJSON(&out, &counter.DiffReport{}); err != nil {
+		t.Fatalf("Failed to write diff: %v", err)
+	}
+	if !strings.Contains(out.String(), `"files": []`) {
+		t.Errorf("Expected an empty file list, got %q", out.String())
+	}
+}
+
+func TestCommandContext(t *testing.T) {
+	ctx, cancel := commandContext(10 * time.Millisecond)
+	defer cancel()
+
+	<-ctx.Done()
+	if !interrupted(ctx.Err()) {
+		t.Errorf("Expected a timeout to count as an interrupt, got %v", ctx.Err())
+	}
+
+	// without a timeout the context stays open until cancelled
+	ctx, cancel = commandContext(0)
+	if ctx.Err() != nil {
+		t.Errorf("Expected an open context, got %v", ctx.Err())
+	}
+	cancel()
+	if !interrupted(ctx.Err()) {
+		t.Errorf("Expected a cancelled context, got %v", ctx.Err())
+	}
+
+	if interrupted(errors.New("exit status 128")) {
+		t.Error("Expected other errors not to count as an interrupt")
 	}
 }
 
-func TestCompileExcludePatterns(t *testing.T) {
+func TestFormatProgress(t *testing.T) {
 	tests := []struct {
-		name        string
-		patterns    []string
-		expectError bool
+		name     string
+		progress counter.Progress
+		elapsed  time.Duration
+		expected string
 	}{
 		{
-			name:        "Valid patterns",
-			patterns:    []string{`.*_test\.go$`, `node_modules/.*`},
-			expectError: false,
+			name:     "unknown total",
+			progress: counter.Progress{FilesVisited: 20, FilesCounted: 10, BytesRead: 2048, Lines: 300, Dir: "src/app"},
+			elapsed:  2 * time.Second,
+			expected: "20 files, 10 counted, 2.0 KiB read, 300 lines, 10 files/s in src/app",
 		},
 		{
-			name:        "Invalid regex",
-			patterns:    []string{`[`}, // Invalid regex
-			expectError: true,
+			name:     "known total",
+			progress: counter.Progress{FilesVisited: 20, FilesCounted: 20, FilesTotal: 100, BytesRead: 512, Lines: 40, Dir: "."},
+			elapsed:  2 * time.Second,
+			expected: "20/100 files, 20 counted, 512 B read, 40 lines, 10 files/s, ETA 8s in .",
 		},
 		{
-			name:        "Empty patterns",
-			patterns:    []string{},
-			expectError: false,
-		},
-		{
-			name:        "Complex patterns",
-			patterns:    []string{`(test|spec)`, `\.(git|build)/`, `^gen/.*\.go$`},
-			expectError: false,
+			name:     "just started",
+			progress: counter.Progress{},
+			expected: "0 files, 0 counted, 0 B read, 0 lines",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			compiled, err := compileExcludePatterns(tt.patterns)
-
-			if tt.expectError {
-				if err == nil {
-					t.Error("Expected error but got none")
-				}
-			} else {
-				if err != nil {
-					t.Errorf("Unexpected error: %v", err)
-				}
-				if len(compiled) != len(tt.patterns) {
-					t.Errorf("Expected %d compiled patterns, got %d", len(tt.patterns), len(compiled))
-				}
+			if got := formatProgress(tt.progress, tt.elapsed); got != tt.expected {
+				t.Errorf("formatProgress() = %q, expected %q", got, tt.expected)
 			}
 		})
 	}
+
+	if got := formatBytes(3 * 1024 * 1024 * 1024); got != "3.0 GiB" {
+		t.Errorf("formatBytes() = %q, expected %q", got, "3.0 GiB")
+	}
 }
 
-func TestExcludeFlagsType(t *testing.T) {
-	var flags excludeFlags
+func TestRunCache(t *testing.T) {
+	if err := runCache(nil); err == nil {
+		t.Error("Expected an error without a subcommand")
+	}
+	if err := runCache([]string{"prune"}); err == nil {
+		t.Error("Expected an error without a cache directory")
+	}
 
-	err := flags.Set("pattern1")
-	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+	cacheDir := t.TempDir()
+	if err := os.WriteFile(cacheDir+"/corrupt.json", []byte("{"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
 	}
 
-	err = flags.Set("pattern2")
+	// silence the summary
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
 	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+		t.Fatalf("Failed to open %s: %v", os.DevNull, err)
 	}
-
-	expected := "pattern1, pattern2"
-	if flags.String() != expected {
-		t.Errorf("Expected %q, got %q", expected, flags.String())
+	oldStdout := os.Stdout
+	os.Stdout = devNull
+	err = runCache([]string{"prune", "-max-age", "0", cacheDir})
+	os.Stdout = oldStdout
+	_ = devNull.Close()
+	if err != nil {
+		t.Fatalf("Failed to prune cache: %v", err)
 	}
 
-	if len(flags) != 2 {
-		t.Errorf("Expected 2 flags, got %d", len(flags))
+	if _, err := os.Stat(cacheDir + "/corrupt.json"); !os.IsNotExist(err) {
+		t.Error("Expected the corrupt cache to be removed")
 	}
 }
 
-func TestMainWithExcludeFlags(t *testing.T) {
-	testDir := setupTestDirectory(t)
-	defer func(path string) {
-		_ = os.RemoveAll(path)
-	}(testDir)
+func TestWriteLanguageDeltas(t *testing.T) {
+	start := &counter.Report{
+		Total: counter.Counts{Code: 12, Comment: 3, Blank: 4},
+		Languages: map[string]counter.Counts{
+			"go":     {Code: 10, Comment: 3, Blank: 4},
+			"python": {Code: 2},
+		},
+	}
+	current := &counter.Report{
+		Total: counter.Counts{Code: 15, Comment: 2, Blank: 4},
+		Languages: map[string]counter.Counts{
+			"go": {Code: 15, Comment: 2, Blank: 4},
+		},
+	}
 
-	origArgs := os.Args
-	origWd, _ := os.Getwd()
-	defer func() {
-		os.Args = origArgs
-		_ = os.Chdir(origWd)
-	}()
+	var buf bytes.Buffer
+	if err := writeLanguageDeltas(&buf, start, current); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
 
-	err := os.Chdir(testDir)
-	if err != nil {
-		t.Fatalf("Failed to change to test directory: %v", err)
+	expected := "Language  Code  ±   Comment  ±   Blank  ±   Generated  ±\n" +
+		"go        15    +5  2        -1  4      +0  0          +0\n" +
+		"python    0     -2  0        +0  0      +0  0          +0\n" +
+		"Total     15    +3  2        -1  4      +0  0          +0\n"
+	if buf.String() != expected {
+		t.Errorf("Expected table:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestReportOutput(t *testing.T) {
+	report := &counter.Report{
+		Total: counter.Counts{Code: 14, Comment: 4, Blank: 3},
+		Files: []counter.FileCounts{
+			{Path: "main.go", Language: "go", Counts: counter.Counts{Code: 4, Blank: 1}},
+			{Path: "pkg/a/a.go", Language: "go", Counts: counter.Counts{Code: 2, Comment: 1}},
+			{Path: "pkg/b/b.go", Language: "go", Counts: counter.Counts{Code: 5, Comment: 2, Blank: 1}},
+			{Path: "web/app.js", Language: "javascript", Counts: counter.Counts{Code: 3, Comment: 1, Blank: 1}},
+		},
 	}
 
 	tests := []struct {
-		name        string
-		args        []string
-		expectError bool
-		shouldCount bool
+		name     string
+		output   reportOutput
+		expected string
 	}{
 		{
-			name:        "Basic directory scan",
-			args:        []string{"cmd", "-dir", "."},
-			expectError: false,
-			shouldCount: true,
-		},
-		{
-			name:        "Exclude test files",
-			args:        []string{"cmd", "-dir", ".", "--exclude", `.*_test\.go$`, "--exclude", `.*\.spec\.ts$`},
-			expectError: false,
-			shouldCount: true,
+			name:     "total",
+			output:   reportOutput{Format: "text", Sort: "name"},
+			expected: "Total lines of code: 14\n",
 		},
 		{
-			name:        "Exclude directories",
-			args:        []string{"cmd", "-dir", ".", "--exclude", `node_modules/.*`, "--exclude", `\.git/.*`},
-			expectError: false,
-			shouldCount: true,
+			name:   "tree by name",
+			output: reportOutput{By: "dir", Format: "text", Sort: "name"},
+			expected: "Directory  Files  Code  Comment  Blank  Generated\n" +
+				".          4      14    4        3      0\n" +
+				"  pkg      2      7     3        1      0\n" +
+				"    a      1      2     1        0      0\n" +
+				"    b      1      5     2        1      0\n" +
+				"  web      1      3     1        1      0\n",
 		},
 		{
-			name:        "Invalid regex pattern",
-			args:        []string{"cmd", "-dir", ".", "--exclude", `[`},
-			expectError: true,
-			shouldCount: false,
+			name:   "tree by size, one level",
+			output: reportOutput{By: "dir", Format: "text", Depth: 1, Sort: "code"},
+			expected: "Directory  Files  Code  Comment  Blank  Generated\n" +
+				".          4      14    4        3      0\n" +
+				"  pkg      2      7     3        1      0\n" +
+				"  web      1      3     1        1      0\n",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			flag.CommandLine = flag.NewFlagSet(tt.args[0], flag.ContinueOnError)
-
+			if err := tt.output.validate(); err != nil {
+				t.Fatalf("Expected valid output options: %v", err)
+			}
 			var buf bytes.Buffer
-			flag.CommandLine.SetOutput(&buf)
+			if err := tt.output.write(&buf, report); err != nil {
+				t.Fatalf("Failed to write report: %v", err)
+			}
+			if buf.String() != tt.expected {
+				t.Errorf("Expected:\n%s\ngot:\n%s", tt.expected, buf.String())
+			}
+		})
+	}
 
-			os.Args = tt.args
+	// JSON nests the directories
+	var buf bytes.Buffer
+	if err := (reportOutput{By: "dir", Format: "json", Sort: "name"}).write(&buf, report); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+	var tree counter.Dir
+	if err := json.Unmarshal(buf.Bytes(), &tree); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	if len(tree.Dirs) != 2 || len(tree.Dirs[0].Dirs) != 2 || tree.Dirs[0].Dirs[1].Path != "pkg/b" || tree.Dirs[0].Dirs[1].Code != 5 {
+		t.Errorf("Unexpected tree: %s", buf.String())
+	}
 
-			var loc Loc
-			var excludePatterns excludeFlags
+	for _, output := range []reportOutput{
+		{By: "file", Format: "text", Sort: "name"},
+		{Format: "xml", Sort: "name"},
+		{By: "dir", Format: "text", Sort: "size"},
+	} {
+		if err := output.validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", output)
+		}
+	}
 
-			dir := flag.String("dir", ".", "directory to count lines of code")
-			flag.Var(&excludePatterns, "exclude", "regex pattern to exclude files/directories")
+	// skipped vendored code is mentioned below the total
+	buf.Reset()
+	vendored := &counter.Report{Total: report.Total, Vendored: []string{"a/vendor", "b/vendor", "node_modules", "third_party"}}
+	if err := (reportOutput{Format: "text", Sort: "name"}).write(&buf, vendored); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+	expected := "Total lines of code: 14\n" +
+		"Skipped vendored code in a/vendor, b/vendor, node_modules and 1 more (-include-vendored to count it)\n"
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
 
-			err := flag.CommandLine.Parse(tt.args[1:])
-			if err != nil && !tt.expectError {
-				t.Fatalf("Unexpected flag parsing error: %v", err)
-			}
-			if err != nil && tt.expectError {
-				return // Expected error, test passed
-			}
+	// binary files are only counted, and listed when verbose
+	binary := &counter.Report{Total: report.Total, Binary: []string{"data/matrix.m", "dump.sql"}}
+	for verbose, expected := range map[bool]string{
+		false: "Total lines of code: 14\nSkipped binary files: 2 (-verbose to list them)\n",
+		true:  "Total lines of code: 14\nSkipped binary files: 2\n  data/matrix.m\n  dump.sql\n",
+	} {
+		buf.Reset()
+		if err := (reportOutput{Format: "text", Sort: "name", Verbose: verbose}).write(&buf, binary); err != nil {
+			t.Fatalf("Failed to write report: %v", err)
+		}
+		if buf.String() != expected {
+			t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+		}
+	}
 
-			loc.Directory = *dir
+	// files with mixed line endings are listed when asked for
+	buf.Reset()
+	mixed := &counter.Report{Total: report.Total, MixedLineEndings: []string{"legacy/form.pas"}}
+	if err := (reportOutput{Format: "text", Sort: "name", MixedLineEndings: true}).write(&buf, mixed); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+	expected = "Total lines of code: 14\nFiles with mixed line endings: 1\n  legacy/form.pas\n"
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
 
-			if len(excludePatterns) > 0 {
-				compiledPatterns, err := compileExcludePatterns(excludePatterns)
-				if err != nil {
-					if tt.expectError {
-						return // Expected error
-					}
-					t.Fatalf("Unexpected error compiling patterns: %v", err)
-				}
-				loc.ExcludePatterns = compiledPatterns
-			}
+func TestWriteRanked(t *testing.T) {
+	report := &counter.Report{
+		Total:     counter.Counts{Code: 1210, Comment: 20},
+		Languages: map[string]counter.Counts{"go": {Code: 1210, Comment: 20}},
+		Files: []counter.FileCounts{
+			{Path: "a.go", Language: "go", Counts: counter.Counts{Code: 10, Comment: 5}},
+			{Path: "b.go", Language: "go", Counts: counter.Counts{Code: 1200, Comment: 15, Blank: 3}},
+		},
+	}
 
-			config, err := readConfig()
-			if err != nil {
-				t.Fatalf("Failed to read config: %v", err)
-			}
-			loc.Config = config
+	var buf bytes.Buffer
+	output := reportOutput{Format: "text", Sort: "name", Top: 1, Outliers: counter.DefaultOutlierOptions}
+	if err := output.write(&buf, report); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
 
-			err = loc.scan()
-			if err != nil {
-				t.Fatalf("Failed to scan: %v", err)
-			}
+	expected := "Total lines of code: 1210\n" +
+		"\n" +
+		"Largest files  Language  Code  Comment  Blank\n" +
+		"b.go           go        1200  15       3\n" +
+		"\n" +
+		"Outliers  Code  Why\n" +
+		"b.go      1200  1200 lines of code, over the limit of 1000\n"
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
 
-			if tt.shouldCount && loc.TotalLines == 0 {
-				t.Error("Expected some lines to be counted")
-			}
+	if !output.files() {
+		t.Error("Expected -top to need the counts of every file")
+	}
 
-			t.Logf("Test %s: Counted %d lines", tt.name, loc.TotalLines)
-		})
+	// the JSON report keeps its totals, with the ranking added to it
+	buf.Reset()
+	output.Format = "json"
+	if err := output.write(&buf, report); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+	var ranked struct {
+		Total     counter.Counts            `json:"total"`
+		Languages map[string]counter.Counts `json:"languages"`
+		Files     []counter.FileCounts      `json:"files"`
+		Top       []counter.FileCounts      `json:"top"`
+		Outliers  []counter.Outlier         `json:"outliers"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &ranked); err != nil {
+		t.Fatalf("Failed to parse report: %v", err)
+	}
+	if ranked.Total != report.Total || ranked.Languages["go"] != report.Languages["go"] {
+		t.Errorf("Expected the totals of the report, got %+v and %+v", ranked.Total, ranked.Languages)
+	}
+	if len(ranked.Top) != 1 || ranked.Top[0].Path != "b.go" || len(ranked.Outliers) != 1 || ranked.Files != nil {
+		t.Errorf("Expected b.go as the top file and outlier and no file list, got %s", buf.String())
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	dir := t.TempDir()
+	if got := findPolicy("", dir); got != "" {
+		t.Errorf("Expected no policy, got %s", got)
+	}
+	policyPath := dir + "/" + counter.PolicyFile
+	if err := os.WriteFile(policyPath, []byte(`{"max_file_lines": 10}`), 0644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	if got := findPolicy("", dir); got != policyPath {
+		t.Errorf("Expected %s, got %s", policyPath, got)
+	}
+	if got := findPolicy("other.json", dir); got != "other.json" {
+		t.Errorf("Expected the given policy, got %s", got)
+	}
+
+	policy, err := counter.LoadPolicy(policyPath)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	report := &counter.Report{Files: []counter.FileCounts{{Path: "big.go", Language: "go", Counts: counter.Counts{Code: 12}}}}
+
+	var buf bytes.Buffer
+	ok, err := checkPolicy(&buf, "policy.json", policy, report)
+	if err != nil {
+		t.Fatalf("Failed to check policy: %v", err)
+	}
+	expected := "Policy policy.json: 1 violations\n  big.go: 12 lines of code, over the limit of 10 per file\n"
+	if ok || buf.String() != expected {
+		t.Errorf("Expected a violation:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	report.Files[0].Code = 10
+	if ok, err := checkPolicy(&buf, "policy.json", policy, report); err != nil || !ok {
+		t.Errorf("Expected the report to be within budget, got %v: %s", err, buf.String())
+	}
+}
+
+func TestSnapshotCompare(t *testing.T) {
+	snapshotPath := t.TempDir() + "/baseline.json"
+
+	// silence the comparison
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", os.DevNull, err)
+	}
+	oldStdout := os.Stdout
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = oldStdout
+		_ = devNull.Close()
+	}()
+
+	if err := runSnapshot([]string{"-o", snapshotPath, "test_dir"}); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	baseline, err := counter.LoadReport(snapshotPath)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	if len(baseline.Files) == 0 || baseline.Total.Code == 0 {
+		t.Errorf("Expected the snapshot to hold every file, got %+v", baseline.Total)
+	}
+
+	// nothing changed, so nothing got worse
+	if err := runCompare([]string{"-ratchet", "-legacy", "test_dir", snapshotPath, "test_dir"}); err != nil {
+		t.Errorf("Expected no ratchet violations, got %v", err)
+	}
+	if err := runCompare(nil); err == nil {
+		t.Error("Expected an error without a snapshot")
+	}
+}
+
+func TestWriteComparisonText(t *testing.T) {
+	baseline := &counter.Report{
+		Total:     counter.Counts{Code: 10, Comment: 2},
+		Languages: map[string]counter.Counts{"go": {Code: 10, Comment: 2}},
+		Files:     []counter.FileCounts{{Path: "legacy/a.go", Language: "go", Counts: counter.Counts{Code: 10, Comment: 2}}},
+	}
+	current := &counter.Report{
+		Total:     counter.Counts{Code: 14, Comment: 2},
+		Languages: map[string]counter.Counts{"go": {Code: 14, Comment: 2}},
+		Files:     []counter.FileCounts{{Path: "legacy/a.go", Language: "go", Counts: counter.Counts{Code: 14, Comment: 2}}},
+	}
+	c := comparison{
+		Comparison: counter.Compare(baseline, current, 1),
+		Violations: counter.Ratchet(baseline, current, []string{"legacy"}),
+	}
+
+	var buf bytes.Buffer
+	if err := writeComparisonText(&buf, baseline, current, c); err != nil {
+		t.Fatalf("Failed to write comparison: %v", err)
+	}
+
+	expected := "Language  Code  ±   Comment  ±   Blank  ±   Generated  ±\n" +
+		"go        14    +4  2        +0  0      +0  0          +0\n" +
+		"Total     14    +4  2        +0  0      +0  0          +0\n" +
+		"\n" +
+		"Directory  Code  ±   Comment  ±   Blank  ±   Generated  ±\n" +
+		".          14    +4  2        +0  0      +0  0          +0\n" +
+		"legacy     14    +4  2        +0  0      +0  0          +0\n" +
+		"\n" +
+		"Ratchet: 2 violations\n" +
+		"  total: comment ratio dropped from 16.7% to 12.5%\n" +
+		"  legacy: legacy code grew from 10 to 14 lines\n"
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
 	}
 }
@@ -0,0 +1,85 @@
+// loc - line budget checks for the count command
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"loc/counter"
+)
+
+// findPolicy returns the policy file to check a count of directory against: the one given, or the policy
+// file in the directory when there is one. It returns an empty path when there is no policy.
+func findPolicy(given, directory string) string {
+	if given != "" {
+		return given
+	}
+
+	path := filepath.Join(directory, counter.PolicyFile)
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+		return path
+	}
+	return ""
+}
+
+// checkPolicy checks a report against a policy and writes the violations. It reports whether the
+// count stayed within every budget.
+func checkPolicy(w io.Writer, policyPath string, policy *counter.Policy, report *counter.Report) (bool, error) {
+	var baseline *counter.Report
+	if policy.NeedsBaseline() {
+		if policy.Baseline == "" {
+			return false, fmt.Errorf("the policy limits growth but names no baseline")
+		}
+		var err error
+		if baseline, err = counter.LoadReport(policy.Baseline); err != nil {
+			return false, err
+		}
+	}
+
+	violations, err := policy.Check(report, baseline)
+	if err != nil {
+		return false, err
+	}
+
+	if len(violations) == 0 {
+		_, err := fmt.Fprintf(w, "Policy %s: within budget\n", policyPath)
+		return true, err
+	}
+
+	_, _ = fmt.Fprintf(w, "Policy %s: %d violations\n", policyPath, len(violations))
+	for _, violation := range violations {
+		_, _ = fmt.Fprintf(w, "  %s: %s\n", violation.Path, violation.Message)
+	}
+	return false, nil
+}
@@ -0,0 +1,131 @@
+// loc - progress line on stderr
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"loc/counter"
+)
+
+// progressInterval is how often the progress line is redrawn
+const progressInterval = 100 * time.Millisecond
+
+// progressPrinter redraws a single progress line on a terminal
+type progressPrinter struct {
+	w     io.Writer // The terminal to draw on
+	start time.Time // When the count started
+	last  time.Time // When the line was last drawn
+	drawn bool      // Whether there is a line to clear
+}
+
+// isTerminal reports whether f is a terminal rather than a file or a pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// newProgressPrinter creates a printer drawing on w
+func newProgressPrinter(w io.Writer) *progressPrinter {
+	return &progressPrinter{w: w, start: time.Now()}
+}
+
+// update redraws the progress line, at most once per progressInterval
+func (p *progressPrinter) update(progress counter.Progress) {
+	now := time.Now()
+	if now.Sub(p.last) < progressInterval {
+		return
+	}
+	p.last = now
+	p.drawn = true
+
+	// carriage return and erase to the end of the line, so a shorter line leaves nothing behind
+	_, _ = fmt.Fprintf(p.w, "\r\x1b[K%s", formatProgress(progress, now.Sub(p.start)))
+}
+
+// clear removes the progress line so the results start on a clean line
+func (p *progressPrinter) clear() {
+	if p.drawn {
+		_, _ = fmt.Fprint(p.w, "\r\x1b[K")
+		p.drawn = false
+	}
+}
+
+// formatProgress formats the progress of a count that has been running for elapsed
+func formatProgress(progress counter.Progress, elapsed time.Duration) string {
+	var b strings.Builder
+
+	if progress.FilesTotal > 0 {
+		fmt.Fprintf(&b, "%d/%d files", progress.FilesVisited, progress.FilesTotal)
+	} else {
+		fmt.Fprintf(&b, "%d files", progress.FilesVisited)
+	}
+	fmt.Fprintf(&b, ", %d counted, %s read, %d lines", progress.FilesCounted, formatBytes(progress.BytesRead), progress.Lines)
+
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		rate := float64(progress.FilesVisited) / seconds
+		fmt.Fprintf(&b, ", %.0f files/s", rate)
+
+		// the time left can only be estimated when the number of files is known
+		if remaining := progress.FilesTotal - progress.FilesVisited; progress.FilesTotal > 0 && rate > 0 && remaining >= 0 {
+			eta := time.Duration(float64(remaining) / rate * float64(time.Second))
+			fmt.Fprintf(&b, ", ETA %s", eta.Round(time.Second))
+		}
+	}
+
+	if progress.Dir != "" {
+		fmt.Fprintf(&b, " in %s", progress.Dir)
+	}
+
+	return b.String()
+}
+
+// formatBytes formats a number of bytes with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,301 @@
+// loc - report output for the count command
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"loc/counter"
+)
+
+// dirOrders are the orders the directories of a rollup can be sorted in, largest first for sizes
+var dirOrders = map[string]func(a, b *counter.Dir) int{
+	"name": func(a, b *counter.Dir) int {
+		return strings.Compare(a.Path, b.Path)
+	},
+	"code": func(a, b *counter.Dir) int {
+		return cmp.Or(cmp.Compare(b.Code, a.Code), strings.Compare(a.Path, b.Path))
+	},
+	"lines": func(a, b *counter.Dir) int {
+		return cmp.Or(cmp.Compare(b.Code+b.Comment+b.Blank, a.Code+a.Comment+a.Blank), strings.Compare(a.Path, b.Path))
+	},
+}
+
+// reportOutput is how the count command writes its report
+type reportOutput struct {
+	By      string // Grouping of the counts: empty for the total only, "dir" for a directory tree
+	Format  string // text or json
+	Depth   int    // Levels of directories in the tree, 0 for all
+	Sort    string // Order of the directories in the tree, one of dirOrders
+	Top     int    // Number of largest files to list, 0 for none
+	Verbose bool   // List the files that were skipped rather than only how many
+
+	MixedLineEndings bool // List the files with mixed line endings
+
+	Outliers counter.OutlierOptions // What makes a file stand out, listed along with the largest files
+}
+
+// rankedReport is the JSON output when the largest files are asked for, the report with the ranking added
+type rankedReport struct {
+	*counter.Report                      // The totals and skipped files, as without -top
+	Dirs            *counter.Dir         `json:"dirs,omitempty"` // The directory tree, with -by dir
+	Top             []counter.FileCounts `json:"top"`            // The largest files, by lines of code
+	Outliers        []counter.Outlier    `json:"outliers"`       // Files that stand out
+}
+
+// validate checks the output options before anything is counted
+func (o reportOutput) validate() error {
+	switch o.By {
+	case "", "dir":
+	default:
+		return fmt.Errorf("invalid -by '%s', expected dir", o.By)
+	}
+	switch o.Format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid format '%s', expected text or json", o.Format)
+	}
+	if _, ok := dirOrders[o.Sort]; !ok {
+		return fmt.Errorf("invalid sort '%s', expected name, code or lines", o.Sort)
+	}
+	if o.Top < 0 {
+		return fmt.Errorf("invalid -top %d, expected a number of files", o.Top)
+	}
+	return nil
+}
+
+// files reports whether the output needs the counts of every file
+func (o reportOutput) files() bool {
+	return o.By == "dir" || o.Top > 0
+}
+
+// maxVendoredPaths is the number of vendored paths named in the text output
+const maxVendoredPaths = 3
+
+// writeVendoredText writes a line on the vendored code that was skipped, so nobody wonders where it went
+func writeVendoredText(w io.Writer, paths []string) {
+	more := ""
+	if len(paths) > maxVendoredPaths {
+		more = fmt.Sprintf(" and %d more", len(paths)-maxVendoredPaths)
+		paths = paths[:maxVendoredPaths]
+	}
+	_, _ = fmt.Fprintf(w, "Skipped vendored code in %s%s (-include-vendored to count it)\n", strings.Join(paths, ", "), more)
+}
+
+// writeSkippedText writes how many files of a kind were skipped, and which with verbose
+func writeSkippedText(w io.Writer, kind string, names []string, verbose bool) {
+	if !verbose {
+		_, _ = fmt.Fprintf(w, "Skipped %s: %d (-verbose to list them)\n", kind, len(names))
+		return
+	}
+	_, _ = fmt.Fprintf(w, "Skipped %s: %d\n", kind, len(names))
+	for _, name := range names {
+		_, _ = fmt.Fprintf(w, "  %s\n", name)
+	}
+}
+
+// write writes the report
+func (o reportOutput) write(w io.Writer, report *counter.Report) error {
+	var tree *counter.Dir
+	if o.By == "dir" {
+		tree = counter.Rollup(report.Files, o.Depth)
+		tree.Sort(dirOrders[o.Sort])
+	}
+
+	var ranked rankedReport
+	if o.Top > 0 {
+		ranked = rankedReport{
+			Dirs:     tree,
+			Top:      counter.Top(report.Files, o.Top),
+			Outliers: counter.Outliers(report.Files, report.Languages, o.Outliers),
+		}
+	}
+
+	if o.Format == "json" {
+		switch {
+		case o.Top > 0:
+			if ranked.Outliers == nil {
+				ranked.Outliers = []counter.Outlier{} // no outliers is an empty list, not null
+			}
+			nested := *report
+			nested.Files = nil // the counts of every file are only gathered to rank them
+			ranked.Report = &nested
+			return writeJSON(w, ranked)
+		case tree != nil:
+			return writeJSON(w, tree)
+		default:
+			return writeJSON(w, report)
+		}
+	}
+
+	if tree != nil {
+		if err := writeRollupText(w, tree); err != nil {
+			return err
+		}
+	} else {
+		_, _ = fmt.Fprintf(w, "Total lines of code: %d\n", report.Total.Code)
+		if report.Total.Generated > 0 { // kept apart so they do not inflate the total
+			_, _ = fmt.Fprintf(w, "Generated lines: %d\n", report.Total.Generated)
+		}
+	}
+	if len(report.Vendored) > 0 {
+		writeVendoredText(w, report.Vendored)
+	}
+	if len(report.Binary) > 0 {
+		writeSkippedText(w, "binary files", report.Binary, o.Verbose)
+	}
+	if len(report.BrokenLinks) > 0 {
+		writeSkippedText(w, "broken links", report.BrokenLinks, o.Verbose)
+	}
+	if len(report.TooLarge) > 0 {
+		writeSkippedText(w, "files over the size limit", report.TooLarge, o.Verbose)
+	}
+	if len(report.InvalidNotebooks) > 0 {
+		writeSkippedText(w, "invalid notebooks", report.InvalidNotebooks, o.Verbose)
+	}
+	if o.MixedLineEndings {
+		_, _ = fmt.Fprintf(w, "Files with mixed line endings: %d\n", len(report.MixedLineEndings))
+		for _, name := range report.MixedLineEndings {
+			_, _ = fmt.Fprintf(w, "  %s\n", name)
+		}
+	}
+
+	if o.Top > 0 {
+		_, _ = fmt.Fprintln(w)
+		return writeRankedText(w, ranked)
+	}
+	return nil
+}
+
+// writeJSON writes v as indented JSON
+func writeJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeRollupText writes a directory tree as a table, indenting every directory below its parent
+func writeRollupText(w io.Writer, root *counter.Dir) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprint(tw, "Directory\tFiles\tCode\tComment\tBlank\tGenerated\n")
+
+	var writeDir func(d *counter.Dir, level int)
+	writeDir = func(d *counter.Dir, level int) {
+		name := d.Path
+		if level > 0 { // the parent already shows the rest of the path
+			name = path.Base(d.Path)
+		}
+		_, _ = fmt.Fprintf(tw, "%s%s\t%d\t%d\t%d\t%d\t%d\n", strings.Repeat("  ", level), name, d.Files, d.Code, d.Comment, d.Blank, d.Generated)
+		for _, sub := range d.Dirs {
+			writeDir(sub, level+1)
+		}
+	}
+	writeDir(root, 0)
+
+	return tw.Flush()
+}
+
+// writeRankedText writes the largest files and the outliers as tables
+func writeRankedText(w io.Writer, ranked rankedReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprint(tw, "Largest files\tLanguage\tCode\tComment\tBlank\n")
+	for _, file := range ranked.Top {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", file.Path, file.Language, file.Code, file.Comment, file.Blank)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintln(w)
+
+	if len(ranked.Outliers) == 0 {
+		_, err := fmt.Fprintln(w, "No outliers")
+		return err
+	}
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprint(tw, "Outliers\tCode\tWhy\n")
+	for _, outlier := range ranked.Outliers {
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%s\n", outlier.Path, outlier.Code, strings.Join(outlier.Reasons, "; "))
+	}
+	return tw.Flush()
+}
+
+// writeLanguageDeltas writes the lines per language of current, with the change since start next to every count
+func writeLanguageDeltas(w io.Writer, start, current *counter.Report) error {
+	// languages that were removed since the start still show their delta
+	languageSet := make(map[string]bool)
+	for language := range start.Languages {
+		languageSet[language] = true
+	}
+	for language := range current.Languages {
+		languageSet[language] = true
+	}
+	languages := make([]string, 0, len(languageSet))
+	for language := range languageSet {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprint(tw, "Language\tCode\t±\tComment\t±\tBlank\t±\tGenerated\t±\n")
+	for _, language := range languages {
+		writeDeltaRow(tw, language, start.Languages[language], current.Languages[language])
+	}
+	writeDeltaRow(tw, "Total", start.Total, current.Total)
+
+	return tw.Flush()
+}
+
+// writeDeltaRow writes a table row with the lines now and the change since old
+func writeDeltaRow(w io.Writer, name string, old, now counter.Counts) {
+	_, _ = fmt.Fprintf(w, "%s\t%d\t%+d\t%d\t%+d\t%d\t%+d\t%d\t%+d\n", name,
+		now.Code, now.Code-old.Code,
+		now.Comment, now.Comment-old.Comment,
+		now.Blank, now.Blank-old.Blank,
+		now.Generated, now.Generated-old.Generated)
+}
+
+// writeDirDeltas writes the lines per directory after a change, with the change next to every count
+func writeDirDeltas(w io.Writer, dirs []counter.DirChange) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprint(tw, "Directory\tCode\t±\tComment\t±\tBlank\t±\tGenerated\t±\n")
+	for _, dir := range dirs {
+		writeDeltaRow(tw, dir.Path, dir.Before, dir.After)
+	}
+	return tw.Flush()
+}
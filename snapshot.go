@@ -0,0 +1,199 @@
+// loc - snapshot and compare commands
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"loc/counter"
+)
+
+// countFlags registers the flags that select what is counted, shared by count, watch, snapshot and compare
+// so a snapshot and its comparison can be made with the same flags
+func countFlags(flags *flag.FlagSet, opts *counter.Options, excludePatterns *excludeFlags) {
+	flags.Var(excludePatterns, "exclude", "regex pattern to exclude files/directories (can be used multiple times)")
+	flags.BoolVar(&opts.GitTracked, "git-tracked", false, "count only files tracked by git")
+	flags.BoolVar(&opts.GitUntracked, "git-untracked", false, "with -git-tracked, also count untracked files that are not ignored")
+	flags.BoolVar(&opts.CountGenerated, "count-generated", false, "count generated files and lockfiles like any other instead of as generated lines")
+	flags.BoolVar(&opts.FollowSymlinks, "follow-symlinks", false, "walk symlinked directories, counting every file once")
+	limitFlags(flags, opts)
+	flags.BoolVar(&opts.IncludeVendored, "include-vendored", false, "count vendored code like vendor/ and node_modules/ instead of skipping it")
+}
+
+// runSnapshot runs the snapshot command, saving the counts of every file to compare with later
+func runSnapshot(args []string) error {
+	var excludePatterns excludeFlags
+	opts := counter.Options{Files: true}
+
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	out := flags.String("o", "-", "file to write the snapshot to, - for stdout")
+	countFlags(flags, &opts, &excludePatterns)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	directory := "."
+	if flags.NArg() > 0 { // the directory to snapshot
+		directory = flags.Arg(0)
+	}
+	opts.ExcludePatterns = excludePatterns
+
+	var err error
+	opts.Config, err = counter.LoadConfig(counter.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(0)
+	defer cancel()
+
+	report, err := counter.Count(ctx, directory, opts)
+	if err != nil {
+		return err // a partial snapshot is no baseline
+	}
+
+	root, err := filepath.Abs(directory)
+	if err != nil {
+		return err
+	}
+	snapshot := counter.Snapshot{Version: counter.SnapshotVersion, Created: time.Now().UTC(), Root: root, Report: *report}
+
+	if *out == "-" {
+		return writeJSON(os.Stdout, snapshot)
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(file, snapshot); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// comparison is the JSON output of the compare command
+type comparison struct {
+	*counter.Comparison
+	Violations []counter.Violation `json:"violations,omitempty"` // What got worse, with -ratchet
+}
+
+// writeComparisonText writes the changes per language and per directory, and what got worse
+func writeComparisonText(w io.Writer, baseline, current *counter.Report, c comparison) error {
+	if err := writeLanguageDeltas(w, baseline, current); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintln(w)
+	if err := writeDirDeltas(w, c.Dirs); err != nil {
+		return err
+	}
+
+	for i, violation := range c.Violations {
+		if i == 0 {
+			_, _ = fmt.Fprintf(w, "\nRatchet: %d violations\n", len(c.Violations))
+		}
+		_, _ = fmt.Fprintf(w, "  %s: %s\n", violation.Path, violation.Message)
+	}
+	return nil
+}
+
+// runCompare runs the compare command, showing the change since a snapshot
+func runCompare(args []string) error {
+	var excludePatterns, legacyDirs excludeFlags
+	opts := counter.Options{Files: true}
+
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	depth := flags.Int("depth", 1, "levels of directories to compare, 0 for all")
+	format := flags.String("format", "text", "output format: text or json")
+	ratchet := flags.Bool("ratchet", false, "fail when the comment ratio dropped or a -legacy directory grew")
+	flags.Var(&legacyDirs, "legacy", "with -ratchet, directory whose lines of code may not grow (can be used multiple times)")
+	countFlags(flags, &opts, &excludePatterns)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return fmt.Errorf("expected a snapshot to compare with")
+	}
+	directory := "."
+	if flags.NArg() > 1 { // the directory to compare, the current one by default
+		directory = flags.Arg(1)
+	}
+	opts.ExcludePatterns = excludePatterns
+
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("invalid format '%s', expected text or json", *format)
+	}
+
+	baseline, err := counter.LoadReport(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	opts.Config, err = counter.LoadConfig(counter.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(0)
+	defer cancel()
+
+	current, err := counter.Count(ctx, directory, opts)
+	if err != nil {
+		return err
+	}
+
+	result := comparison{Comparison: counter.Compare(baseline, current, *depth)}
+	if *ratchet {
+		result.Violations = counter.Ratchet(baseline, current, legacyDirs)
+	}
+
+	if *format == "json" {
+		err = writeJSON(os.Stdout, result)
+	} else {
+		err = writeComparisonText(os.Stdout, baseline, current, result)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(result.Violations) > 0 {
+		return fmt.Errorf("%d ratchet violations", len(result.Violations))
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+-- Bestellungen je Gre
+SELECT gre, COUNT(*)
+FROM bestellungen
+GROUP BY gre;
+
+-- Ende
@@ -0,0 +1,6 @@
+-- Bestellungen je Größe
+SELECT größe, COUNT(*)
+FROM bestellungen
+GROUP BY größe;
+
+-- Ende
@@ -0,0 +1,91 @@
+// loc - watch command redrawing counts as files change
+// BSD 3-Clause License
+//
+// Copyright (c) 2024, Alex Gaetano Padula
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"loc/counter"
+)
+
+// runWatch runs the watch command, counting a directory again whenever files below it change
+func runWatch(args []string) error {
+	var excludePatterns excludeFlags
+	opts := counter.Options{}
+
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	interval := flags.Duration("interval", time.Second, "how often to check for changes")
+	countFlags(flags, &opts, &excludePatterns)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	directory := "."
+	if flags.NArg() > 0 { // the directory to watch
+		directory = flags.Arg(0)
+	}
+	opts.ExcludePatterns = excludePatterns
+
+	var err error
+	opts.Config, err = counter.LoadConfig(counter.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(0) // runs until Ctrl-C
+	defer cancel()
+
+	// redraw in place on a terminal, append the tables otherwise
+	terminal := isTerminal(os.Stdout)
+
+	var start *counter.Report
+	err = counter.Watch(ctx, directory, opts, *interval, func(report *counter.Report) error {
+		if start == nil {
+			start = report // deltas are since the watch started
+		}
+
+		if terminal {
+			fmt.Print("\x1b[H\x1b[2J") // move home and clear the screen
+		} else if report != start {
+			fmt.Println()
+		}
+		fmt.Printf("Watching %s, counted at %s\n\n", directory, time.Now().Format("15:04:05"))
+		return writeLanguageDeltas(os.Stdout, start, report)
+	})
+	if interrupted(err) {
+		return nil // Ctrl-C is how a watch ends
+	}
+	return err
+}